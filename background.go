@@ -0,0 +1,41 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"sync"
+)
+
+// background holds the jobs processing rotated files, such as their
+// encryption, which run off the write path without the handler lock.
+type background struct {
+	wg   sync.WaitGroup
+	last chan struct{}
+}
+
+// runBackground runs job in a new goroutine, after the jobs started
+// before it, so that the jobs of consecutive rotations run in order.
+// It must be called with the handler lock held; jobs that need the
+// handler state must take it themselves.
+func (h handler) runBackground(job func()) {
+	prev := h.st.background.last
+	done := make(chan struct{})
+	h.st.background.last = done
+	h.st.background.wg.Add(1)
+	go func() {
+		defer h.st.background.wg.Done()
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		job()
+	}()
+}
+
+// waitBackground waits for the background jobs to finish.
+// It must be called without the handler lock held.
+func (h handler) waitBackground() {
+	h.st.background.wg.Wait()
+}
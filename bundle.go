@@ -0,0 +1,328 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BundlePeriod is the type of the constants selecting the
+// periods whose rotated files are bundled by ArchiveBundle.
+type BundlePeriod int
+
+const (
+	// BundleDaily bundles the rotated files of every day.
+	BundleDaily BundlePeriod = iota
+	// BundleMonthly bundles the rotated files of every month.
+	BundleMonthly
+	// BundleYearly bundles the rotated files of every year.
+	BundleYearly
+)
+
+// start returns the start of the period t belongs to.
+func (p BundlePeriod) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch p {
+	case BundleMonthly:
+		d = 1
+	case BundleYearly:
+		m, d = time.January, 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// layout returns the date time layout naming the bundles of the period.
+func (p BundlePeriod) layout() string {
+	switch p {
+	case BundleMonthly:
+		return "2006-01"
+	case BundleYearly:
+		return "2006"
+	}
+	return "2006-01-02"
+}
+
+// end returns the end of the period starting at start.
+func (p BundlePeriod) end(start time.Time) time.Time {
+	switch p {
+	case BundleMonthly:
+		return start.AddDate(0, 1, 0)
+	case BundleYearly:
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// isBundleFileName reports whether name is the name of a bundle.
+func (cnf *config) isBundleFileName(name string) bool {
+	_, ok := cnf.trimFilePrefix(name)
+	return cnf.bundle && ok && strings.HasSuffix(name, BUNDLE_FILE_EXTENSION)
+}
+
+// bundleTime returns the end of the period of the bundle named name,
+// if it is named after the default layout, so that bundles are aged by
+// the newest rotated files they can hold.
+func (cnf *config) bundleTime(name string) (time.Time, bool) {
+	if cnf.bundleNameFunc != nil {
+		return time.Time{}, false
+	}
+	rest, ok := cnf.trimFilePrefix(name)
+	if !ok || !strings.HasSuffix(rest, BUNDLE_FILE_EXTENSION) {
+		return time.Time{}, false
+	}
+	start, err := time.ParseInLocation(cnf.bundlePeriod.layout(), strings.TrimSuffix(rest, BUNDLE_FILE_EXTENSION), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return cnf.bundlePeriod.end(start), true
+}
+
+// bundleName returns the name of the bundle of the period starting at start.
+func (cnf *config) bundleName(start time.Time) (string, error) {
+	if cnf.bundleNameFunc == nil {
+		return cnf.filePrefix + start.Format(cnf.bundlePeriod.layout()) + BUNDLE_FILE_EXTENSION, nil
+	}
+	name := cnf.bundleNameFunc(start)
+	if name == "" || filepath.Base(name) != name || !strings.HasSuffix(name, BUNDLE_FILE_EXTENSION) {
+		return "", fmt.Errorf("invalid bundle file name %q", name)
+	}
+	return name, nil
+}
+
+// bundleResult describes a bundle written by bundleRotatedFiles.
+type bundleResult struct {
+	dir   string
+	name  string
+	names []string
+}
+
+// bundleRotatedFiles starts bundling in the background the rotated files
+// of the periods completed since the previous call, in every log directory.
+// The background job works on a snapshot of the configuration and takes
+// the handler lock only to report the bundles written.
+func (h handler) bundleRotatedFiles() {
+	current := h.cnf.bundlePeriod.start(h.cnf.clock())
+	if current.Equal(h.st.bundledPeriod) {
+		return
+	}
+	h.st.bundledPeriod = current
+	cnf := *h.cnf
+	var late string
+	if h.st.late != nil {
+		late = h.st.late.Name()
+	}
+	h.runBackground(func() {
+		bh := handler{cnf: &cnf}
+		results, err := bh.bundleRotatedFilesBefore(current, late)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, res := range results {
+			if h.st.dirCache != nil && res.dir == h.cnf.logDir {
+				for _, name := range res.names {
+					h.st.dirCache.remove(name)
+				}
+				h.st.dirCache.add(res.name)
+			}
+			h.meta(slog.LevelInfo, "bundled rotated log files", "bundle", filepath.Join(res.dir, res.name), "files", len(res.names))
+		}
+		if err != nil {
+			h.reportError(fmt.Errorf("%w: %w", ErrArchive, err))
+		}
+	})
+}
+
+// bundleRotatedFilesBefore bundles the rotated files of the periods
+// preceding the one starting at current, in every log directory, except
+// for the file at late, which is still receiving late records.
+func (h handler) bundleRotatedFilesBefore(current time.Time, late string) ([]bundleResult, error) {
+	var results []bundleResult
+	for i := 0; ; i++ {
+		dir := h.cnf.spillDir(i)
+		res, err := h.bundleRotatedFilesIn(dir, current, late)
+		results = append(results, res...)
+		if i > 0 && errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return results, err
+		}
+		if h.cnf.maxFilesPerDir <= 0 {
+			break
+		}
+	}
+	return results, nil
+}
+
+// bundleRotatedFilesIn bundles the rotated files of dir
+// belonging to the periods preceding the current one.
+func (h handler) bundleRotatedFilesIn(dir string, current time.Time, late string) ([]bundleResult, error) {
+	periods := map[time.Time][]string{}
+	err := h.scanDir(dir, func(name string) error {
+		if !h.cnf.isRotatedFileName(name) || strings.HasSuffix(name, BUNDLE_FILE_EXTENSION+".tmp") {
+			return nil
+		}
+		if filepath.Join(dir, name) == late {
+			// Still receiving late records, see LateWriteGrace.
+			return nil
+		}
+		t, ok := h.cnf.rotatedFileTime(name)
+		if !ok {
+			info, err := os.Lstat(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			t = info.ModTime()
+		}
+		if start := h.cnf.bundlePeriod.start(t); start.Before(current) {
+			periods[start] = append(periods[start], name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var results []bundleResult
+	for start, names := range periods {
+		sort.Strings(names)
+		name, err := h.bundle(dir, start, names)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, bundleResult{dir: dir, name: name, names: names})
+	}
+	return results, nil
+}
+
+// bundle writes the rotated files of dir named names, belonging to the
+// period starting at start, to the bundle of the period and removes them,
+// returning the name of the bundle. An existing bundle of the period is
+// extended with them.
+func (h handler) bundle(dir string, start time.Time, names []string) (string, error) {
+	name, err := h.cnf.bundleName(start)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	// Like encrypted files, bundles are written to a temporary file
+	// renamed when complete: see encryptFile.
+	tmpPath := path + ".tmp"
+	f, err := openFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, DEFAULT_FILE_MODE, h.cnf.strictFileMode)
+	if err != nil {
+		return "", err
+	}
+	err = writeBundle(f, path, dir, names)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	for _, name := range names {
+		err = os.Remove(filepath.Join(dir, name))
+		if err == nil {
+			err = removeSidecars(filepath.Join(dir, name))
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// writeBundle writes to w a gzip compressed tar archive holding the entries
+// of the existing bundle at path, if any, and the files of dir named names.
+func writeBundle(w io.Writer, path, dir string, names []string) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	err := copyBundle(tw, path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = addToBundle(tw, filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// copyBundle copies the entries of the bundle at path, if it exists, to tw.
+func copyBundle(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// addToBundle streams the file at path to tw.
+func addToBundle(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
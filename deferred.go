@@ -0,0 +1,143 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// DeferredPersist makes the handler keep the records in memory instead of
+// writing them, until Persist is called, e.g. by a test or CI job that
+// failed: the log directory and files are not touched before then, so that
+// runs ending without Persist leave nothing on disk, as Close discards the
+// buffered records. Records are formatted when they are handled and at most
+// maxBytes bytes of formatted records are kept: when the limit is exceeded
+// the oldest records are evicted, and counted by SummaryInterval with the
+// "deferred" reason. Rotate, Flush and Reopen do nothing while records are
+// deferred. The ExtraFormat formats are deferred and persisted together
+// with the main one.
+// If maxBytes is 0 records are written immediately.
+func DeferredPersist(maxBytes int) optFun {
+	return func(cnf *config) {
+		cnf.deferredPersist = maxBytes
+	}
+}
+
+// deferredRecord is a record kept in memory by DeferredPersist,
+// as formatted by the formatter handler, before framing.
+type deferredRecord struct {
+	time  time.Time
+	level slog.Level
+	data  []byte
+}
+
+// deferredRecords is the memory buffer of DeferredPersist.
+type deferredRecords struct {
+	records []deferredRecord
+	size    int
+}
+
+// deferRecord formats r and keeps it in memory, evicting
+// the oldest records exceeding the DeferredPersist limit.
+func (h handler) deferRecord(ctx context.Context, r slog.Record) error {
+	h.buf.Reset()
+	err := h.formatter.Handle(ctx, r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	if h.buf.Len() == 0 {
+		h.drop(dropFiltered)
+		return nil
+	}
+	data := bytes.Clone(h.buf.Bytes())
+	h.buf.Reset()
+	d := h.st.deferred
+	d.records = append(d.records, deferredRecord{time: r.Time, level: r.Level, data: data})
+	d.size += len(data)
+	for d.size > h.cnf.deferredPersist {
+		d.size -= len(d.records[0].data)
+		d.records[0] = deferredRecord{}
+		d.records = d.records[1:]
+		h.drop(dropDeferred)
+	}
+	return nil
+}
+
+// replayFormatter is the formatter handler writing
+// the data of a deferred record when it is persisted.
+type replayFormatter struct {
+	w    io.Writer
+	data []byte
+}
+
+func (f *replayFormatter) Enabled(context.Context, slog.Level) bool { return true }
+
+func (f *replayFormatter) Handle(context.Context, slog.Record) error {
+	_, err := f.w.Write(f.data)
+	return err
+}
+
+func (f *replayFormatter) WithAttrs([]slog.Attr) slog.Handler { return f }
+
+func (f *replayFormatter) WithGroup(string) slog.Handler { return f }
+
+// Persist implements the method of the Handler interface.
+func (h handler) Persist() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.st.closed {
+		return ErrClosed
+	}
+	d := h.st.deferred
+	if d == nil {
+		return nil
+	}
+	h.st.deferred = nil
+	err := h.openFiles()
+	if err != nil {
+		if !h.cnf.fallbackToStderr {
+			h.st.deferred = d
+			return err
+		}
+		h.fallBack(err)
+	}
+	if h.cnf.deleteAfter > 0 && !h.st.degraded {
+		err = h.scheduleMarkedFiles()
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrCleanup, err)
+		}
+	}
+	// Write the deferred records through the usual path, with a formatter
+	// replaying their data, so that framing and rotation apply.
+	replay := &replayFormatter{w: h.buf}
+	rh := h
+	rh.formatter = replay
+	ctx := context.Background()
+	errs := []error{err}
+	for _, rec := range d.records {
+		replay.data = rec.data
+		err := rh.prepareFile()
+		if err == nil {
+			err = rh.writeFile(ctx, slog.NewRecord(rec.time, rec.level, "", 0))
+		}
+		rh.updateHealth(err)
+		if err != nil {
+			rh.reportError(err)
+			rh.drop(dropError)
+			errs = append(errs, err)
+		}
+	}
+	for _, x := range h.st.extras {
+		errs = append(errs, x.Persist())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import "log/slog"
+
+// derivation records the WithAttrs and WithGroup calls made on a handler
+// in lazy mode, to be applied to its formatter on the first Handle.
+type derivation struct {
+	ops       []derivationOp
+	formatter slog.Handler
+}
+
+// derivationOp is a single WithAttrs call, if attrs is not nil,
+// or WithGroup call.
+type derivationOp struct {
+	attrs []slog.Attr
+	group string
+}
+
+// derive returns a derivation extending the one of h, if any, with op.
+func (h handler) derive(op derivationOp) *derivation {
+	var ops []derivationOp
+	if h.derived != nil {
+		ops = make([]derivationOp, len(h.derived.ops), len(h.derived.ops)+1)
+		copy(ops, h.derived.ops)
+	}
+	return &derivation{ops: append(ops, op)}
+}
+
+// resolve returns the formatter obtained applying the derivation to base,
+// computing it on the first call. It must be called with the lock held.
+func (d *derivation) resolve(base slog.Handler) slog.Handler {
+	if d.formatter == nil {
+		f := base
+		for _, op := range d.ops {
+			if op.attrs != nil {
+				f = f.WithAttrs(op.attrs)
+			} else {
+				f = f.WithGroup(op.group)
+			}
+		}
+		d.formatter = f
+	}
+	return d.formatter
+}
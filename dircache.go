@@ -0,0 +1,149 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dirCache keeps the modification times of the files in the log directory,
+// so that retention does not need to read the whole directory on every
+// rotation. The handler updates it with the files it renames and removes;
+// external changes are tracked by a directory watcher, where available,
+// or by rescanning the directory every DEFAULT_RESCAN_INTERVAL.
+type dirCache struct {
+	mu      sync.Mutex
+	dir     string
+	files   map[string]time.Time
+	valid   bool
+	scanned time.Time
+	watcher func() error
+}
+
+func newDirCache(dir string) *dirCache {
+	c := &dirCache{dir: dir}
+	stop, err := watchDir(dir, c)
+	if err == nil {
+		c.watcher = stop
+	}
+	return c
+}
+
+// scan reads the directory if the cache is invalid or stale.
+func (c *dirCache) scan() error {
+	if c.valid && (c.watcher != nil || time.Since(c.scanned) < DEFAULT_RESCAN_INTERVAL) {
+		return nil
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]time.Time, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files[entry.Name()] = info.ModTime()
+	}
+	c.files = files
+	c.valid = true
+	c.scanned = time.Now()
+	return nil
+}
+
+// oldest returns the name of the oldest file whose name satisfies match,
+// along with the number of matching files and its modification time.
+func (c *dirCache) oldest(match func(name string) bool) (string, uint64, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.scan()
+	if err != nil {
+		return "", 0, time.Time{}, err
+	}
+	var n uint64
+	var oldestName string
+	var oldestTime time.Time
+	for name, modTime := range c.files {
+		if !match(name) {
+			continue
+		}
+		n++
+		if oldestName == "" || modTime.Before(oldestTime) {
+			oldestName, oldestTime = name, modTime
+		}
+	}
+	return oldestName, n, oldestTime, nil
+}
+
+// list returns the modification times of the files
+// whose names satisfy match, keyed by name.
+func (c *dirCache) list(match func(name string) bool) (map[string]time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.scan()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]time.Time{}
+	for name, modTime := range c.files {
+		if match(name) {
+			files[name] = modTime
+		}
+	}
+	return files, nil
+}
+
+// add records the file with the given name, reading its modification time.
+func (c *dirCache) add(name string) {
+	info, err := os.Stat(filepath.Join(c.dir, name))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files == nil {
+		return
+	}
+	if err != nil {
+		delete(c.files, name)
+		return
+	}
+	c.files[name] = info.ModTime()
+}
+
+// remove forgets the file with the given name.
+func (c *dirCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.files, name)
+}
+
+// invalidate forces a rescan of the directory.
+// If lost is true the watcher is no longer reliable and
+// periodic rescans are used from now on.
+func (c *dirCache) invalidate(lost bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.valid = false
+	if lost && c.watcher != nil {
+		go c.watcher()
+		c.watcher = nil
+	}
+}
+
+// close stops the directory watcher.
+func (c *dirCache) close() error {
+	c.mu.Lock()
+	stop := c.watcher
+	c.watcher = nil
+	c.mu.Unlock()
+	if stop == nil {
+		return nil
+	}
+	return stop()
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// watchDir keeps c in sync with the changes to dir using inotify.
+// It returns a function stopping the watcher.
+func watchDir(dir string, c *dirCache) (func() error, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	const mask = syscall.IN_CREATE | syscall.IN_ATTRIB | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+		syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	_, err = syscall.InotifyAddWatch(fd, dir, mask)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// The file is non-blocking, so reads go through the runtime poller
+	// and are interrupted when the file is closed.
+	f := os.NewFile(uintptr(fd), "inotify")
+	go readEvents(f, c)
+	return f.Close, nil
+}
+
+func readEvents(f *os.File, c *dirCache) {
+	var buf [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+	for {
+		n, err := f.Read(buf[:])
+		if err != nil {
+			c.invalidate(true)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			switch {
+			case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+				c.invalidate(false)
+			case event.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF|syscall.IN_IGNORED) != 0:
+				c.invalidate(true)
+				return
+			case event.Mask&(syscall.IN_CREATE|syscall.IN_ATTRIB|syscall.IN_MOVED_TO) != 0:
+				c.add(name)
+			case event.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+				c.remove(name)
+			}
+		}
+	}
+}
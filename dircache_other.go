@@ -0,0 +1,15 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package rotoslog
+
+import "errors"
+
+// watchDir is not supported on this platform:
+// the directory cache relies on periodic rescans.
+func watchDir(dir string, c *dirCache) (func() error, error) {
+	return nil, errors.New("rotoslog: directory watching is not supported on this platform")
+}
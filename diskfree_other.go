@@ -0,0 +1,13 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || darwin || freebsd || dragonfly || windows)
+
+package rotoslog
+
+// freeSpace is not supported on this platform: the volume
+// is always reported as having unlimited free space.
+func freeSpace(path string) (uint64, error) {
+	return maxUint64, nil
+}
@@ -0,0 +1,20 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || dragonfly
+
+package rotoslog
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged
+// users on the volume containing path.
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted files start with a header made of encryptionMagic, the
+// byte identifying the encryption algorithm and the length of the
+// nonce as a single byte, followed by the nonce and the ciphertext.
+const (
+	encryptionMagic = "RSLE"
+	algorithmAESGCM = 1
+)
+
+// encryptInBackground encrypts the rotated file at path in the background,
+// reporting the error, if any, and leaving the file unencrypted.
+func (h handler) encryptInBackground(path string) {
+	keyProvider, strict := h.cnf.encryptionKey, h.cnf.strictFileMode
+	h.runBackground(func() {
+		encPath, err := encryptFile(keyProvider, path, strict)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if err != nil {
+			h.reportError(fmt.Errorf("%w: %w", ErrEncrypt, err))
+			return
+		}
+		if h.st.dirCache != nil && filepath.Dir(path) == filepath.Clean(h.cnf.logDir) {
+			h.st.dirCache.remove(filepath.Base(path))
+			h.st.dirCache.add(filepath.Base(encPath))
+		}
+		h.meta(slog.LevelInfo, "encrypted rotated log file", "path", encPath)
+	})
+}
+
+// encryptFile encrypts the rotated file at path with the key returned by
+// keyProvider, writing it to path with the [ENCRYPTED_FILE_EXTENSION]
+// extension appended and removing the plaintext file. It returns the path
+// of the encrypted file, created as by openFile with strict.
+func encryptFile(keyProvider func() ([]byte, error), path string, strict bool) (string, error) {
+	key, err := keyProvider()
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, 0, len(encryptionMagic)+2+len(nonce)+len(plaintext)+aead.Overhead())
+	data = append(data, encryptionMagic...)
+	data = append(data, algorithmAESGCM, byte(len(nonce)))
+	data = append(data, nonce...)
+	data = aead.Seal(data, nonce, plaintext, nil)
+
+	// A temporary file left behind by a crash is taken for
+	// a rotated file, and eventually removed by retention.
+	encPath := path + ENCRYPTED_FILE_EXTENSION
+	tmpPath := encPath + ".tmp"
+	err = writeFile(tmpPath, data, DEFAULT_FILE_MODE, strict)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tmpPath, encPath)
+	if err != nil {
+		return "", err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return "", err
+	}
+	for _, ext := range sidecarExtensions {
+		err = os.Rename(path+ext, encPath+ext)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	return encPath, nil
+}
+
+// DecryptFile returns the content of the log file at path,
+// encrypted with key by the handler enabling WithEncryption.
+func DecryptFile(path string, key []byte) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(data, key)
+}
+
+// decrypt returns the plaintext of the encrypted file content data.
+func decrypt(data, key []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptionMagic)) || len(data) < len(encryptionMagic)+2 {
+		return nil, errors.New("rotoslog: not an encrypted log file")
+	}
+	data = data[len(encryptionMagic):]
+	if data[0] != algorithmAESGCM {
+		return nil, fmt.Errorf("rotoslog: unknown encryption algorithm %d", data[0])
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := int(data[1])
+	data = data[2:]
+	if nonceSize != aead.NonceSize() || len(data) < nonceSize {
+		return nil, errors.New("rotoslog: invalid encrypted log file header")
+	}
+	return aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+}
+
+// newAEAD returns an AES-GCM cipher using key, which must
+// be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
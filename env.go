@@ -0,0 +1,123 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionsFromEnv returns the options set by the environment variables named
+// after prefix, followed by an underscore if prefix is not empty:
+//   - <prefix>_LOG_DIR: the LogDir option
+//   - <prefix>_FILE_PREFIX: the FilePrefix option
+//   - <prefix>_FILE_EXT: the FileExt option
+//   - <prefix>_MAX_FILE_SIZE: the MaxFileSize option, as a number of bytes
+//     with an optional K, M or G multiplier suffix, e.g. "64M"
+//   - <prefix>_MAX_ROTATED_FILES: the MaxRotatedFiles option
+//   - <prefix>_MAX_AGE: the MaxAge option, as a [time.ParseDuration] duration
+//   - <prefix>_LEVEL: the minimum level of HandlerOptions, as parsed by
+//     [slog.Level.UnmarshalText], e.g. "DEBUG" or "WARN+2"
+//   - <prefix>_FORMAT: the formatting handler, "json" or "text"
+//
+// Unset or empty variables are skipped, leaving the defaults in place.
+// If a variable is malformed an error wrapping ErrInvalidConfig is returned.
+// The options can be followed by others, overriding them.
+func OptionsFromEnv(prefix string) ([]optFun, error) {
+	if prefix != "" {
+		prefix += "_"
+	}
+	var options []optFun
+	lookup := func(name string) (string, bool) {
+		value := os.Getenv(prefix + name)
+		return value, value != ""
+	}
+	invalid := func(name, value string) error {
+		return fmt.Errorf("%w: invalid %s value %q", ErrInvalidConfig, prefix+name, value)
+	}
+
+	if value, ok := lookup("LOG_DIR"); ok {
+		options = append(options, LogDir(value))
+	}
+	if value, ok := lookup("FILE_PREFIX"); ok {
+		options = append(options, FilePrefix(value))
+	}
+	if value, ok := lookup("FILE_EXT"); ok {
+		options = append(options, FileExt(value))
+	}
+	if value, ok := lookup("MAX_FILE_SIZE"); ok {
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, invalid("MAX_FILE_SIZE", value)
+		}
+		options = append(options, MaxFileSize(size))
+	}
+	if value, ok := lookup("MAX_ROTATED_FILES"); ok {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, invalid("MAX_ROTATED_FILES", value)
+		}
+		options = append(options, MaxRotatedFiles(n))
+	}
+	if value, ok := lookup("MAX_AGE"); ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, invalid("MAX_AGE", value)
+		}
+		options = append(options, MaxAge(d))
+	}
+	if value, ok := lookup("LEVEL"); ok {
+		var level slog.Level
+		err := level.UnmarshalText([]byte(value))
+		if err != nil {
+			return nil, invalid("LEVEL", value)
+		}
+		options = append(options, HandlerOptions(slog.HandlerOptions{Level: level}))
+	}
+	if value, ok := lookup("FORMAT"); ok {
+		switch strings.ToLower(value) {
+		case "json":
+			options = append(options, LogHandlerBuilder(slog.NewJSONHandler))
+		case "text":
+			options = append(options, LogHandlerBuilder(slog.NewTextHandler))
+		default:
+			return nil, invalid("FORMAT", value)
+		}
+	}
+	return options, nil
+}
+
+// parseSize parses a number of bytes followed by an optional
+// K, M or G binary multiplier suffix, e.g. "512K" or "32MB".
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	s = strings.TrimSuffix(s, "I")
+	multiplier := uint64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > maxUint64/multiplier {
+		return 0, strconv.ErrRange
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import "time"
+
+// RotationReason is the type of the constants reporting why a log file was rotated.
+type RotationReason int
+
+const (
+	// RotateSize reports a rotation triggered by the MaxFileSize threshold.
+	RotateSize RotationReason = iota
+	// RotateDaily reports the switch to a new daily file, see DailyFileIsCurrent.
+	RotateDaily
+	// RotateExternal reports the reopening of a current log file
+	// renamed or removed by another process, see DetectExternalRotation.
+	RotateExternal
+	// RotateInterval reports a rotation at the end of a RotateEvery time bucket.
+	RotateInterval
+	// RotateManual reports a rotation requested by calling Rotate.
+	RotateManual
+)
+
+// String returns the name of the rotation reason.
+func (r RotationReason) String() string {
+	switch r {
+	case RotateSize:
+		return "size"
+	case RotateDaily:
+		return "daily"
+	case RotateExternal:
+		return "external"
+	case RotateInterval:
+		return "interval"
+	case RotateManual:
+		return "manual"
+	}
+	return "unknown"
+}
+
+// RotationEvent describes the rotation of a log file.
+type RotationEvent struct {
+	// Reason is why the file was rotated.
+	Reason RotationReason
+	// OldPath is the path the file was written at.
+	OldPath string
+	// NewPath is the path of the file after the rotation. It equals OldPath
+	// for daily files and is empty for files rotated by other processes.
+	NewPath string
+	// Time is when the rotation happened, according to the WithClock clock.
+	Time time.Time
+	// Bytes is the size of the file when it was rotated.
+	Bytes int64
+}
+
+// Events implements the method of the Handler interface.
+func (h handler) Events() <-chan RotationEvent {
+	return h.st.events
+}
+
+// emitEvent counts a rotation and sends a rotation event without
+// blocking, dropping the oldest pending event if the channel is full.
+func (h handler) emitEvent(reason RotationReason, oldPath, newPath string, bytes int64) {
+	h.st.intervalStats.Rotations++
+	ev := RotationEvent{
+		Reason:  reason,
+		OldPath: oldPath,
+		NewPath: newPath,
+		Time:    h.cnf.clock(),
+		Bytes:   bytes,
+	}
+	for {
+		select {
+		case h.st.events <- ev:
+			return
+		default:
+		}
+		select {
+		case <-h.st.events:
+		default:
+		}
+	}
+}
@@ -54,6 +54,22 @@ func ExampleLogHandlerBuilder() {
 	}
 }
 
+func ExampleWithFormatters() {
+	h, err := rotoslog.NewHandler(
+		rotoslog.WithFormatters(
+			formatter.FormatByKey("pwd", func(v slog.Value) slog.Value {
+				return slog.StringValue("***********")
+			}),
+			formatter.ErrorFormatter("error"),
+		),
+	)
+	if err != nil {
+		panic(err)
+	}
+	logger := slog.New(h)
+	logger.Info("login", "user", "admin", "pwd", "123456")
+}
+
 func ExampleNewHandler() {
 
 }
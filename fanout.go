@@ -0,0 +1,138 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// extraFormat is a format configured with ExtraFormat.
+type extraFormat struct {
+	nameSuffix string
+	builder    handlerBuilder
+}
+
+// ExtraFormat makes the handler also format every record with the handler
+// built by builder, writing it to a separate set of files whose names have
+// nameSuffix inserted before the file extension, e.g. current.txt.log for the
+// ".txt" suffix. Each set of files is rotated and retained independently,
+// with the same options as the main one, also after Reconfigure, except
+// for HardLinkLatest, CurrentPointerFile, LiveTail, OverflowHandler,
+// LogConfigOnStart, ProbeWrite, Heartbeat, SummaryInterval and
+// WithMetrics, which only apply to the main set.
+// The extra sets share the meta logger of the main one, including the
+// SyslogMeta connection. The option can be repeated to add more
+// formats; nameSuffix must be unique and not empty. Records are handled by
+// the extra formats after the main one, and their errors are joined.
+func ExtraFormat[H slog.Handler](nameSuffix string, builder HandlerBuilder[H]) optFun {
+	return func(cnf *config) {
+		cnf.extraFormats = append(cnf.extraFormats, extraFormat{
+			nameSuffix: nameSuffix,
+			builder: func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+				return builder(w, opts)
+			},
+		})
+	}
+}
+
+// isExtraFormatFileName reports whether name is the
+// name of a file written for one of the ExtraFormat formats.
+func (cnf *config) isExtraFormatFileName(name string) bool {
+	for _, f := range cnf.extraFormats {
+		if strings.Contains(name, f.nameSuffix+cnf.fileExtension) {
+			return true
+		}
+	}
+	return false
+}
+
+// extraConfig returns the configuration of the handler writing the
+// ExtraFormat format f, derived from the configuration cnf of the main
+// handler. The options naming other files, writing to them or acting once
+// for the whole handler only apply to the main handler: the extra handlers
+// share its meta logger and generation instead of opening their own, do
+// not log the configuration nor probe the log directory again, and write
+// no heartbeats or summaries nor report to the metrics collector, so that
+// nothing is counted twice.
+func (h handler) extraConfig(cnf config, f extraFormat) config {
+	cnf.builder = f.builder
+	cnf.fileExtension = f.nameSuffix + cnf.fileExtension
+	cnf.extraFormats = nil
+	cnf.ownExtensionOnly = true
+	cnf.hardLinkLatest = ""
+	cnf.currentPointer = ""
+	cnf.liveTail = false
+	cnf.overflow = nil
+	cnf.syslogMeta = false
+	cnf.logConfigOnStart = false
+	cnf.probeWrite = false
+	cnf.heartbeatInterval = 0
+	cnf.summaryInterval = 0
+	cnf.metrics = nil
+	cnf._currentFilePath = ""
+	if cnf.includeGeneration {
+		cnf.filePrefix = cnf.basePrefix
+		cnf.generation = h.st.generation
+	}
+	return cnf
+}
+
+// openExtraFormats creates the handlers writing the ExtraFormat formats.
+func (h handler) openExtraFormats() error {
+	suffixes := map[string]bool{}
+	for _, f := range h.cnf.extraFormats {
+		if f.nameSuffix == "" || suffixes[f.nameSuffix] {
+			return fmt.Errorf("%w: invalid extra format name suffix %q", ErrInvalidConfig, f.nameSuffix)
+		}
+		suffixes[f.nameSuffix] = true
+		cnf := h.extraConfig(*h.cnf, f)
+		x, err := NewHandler(func(c *config) { *c = cnf })
+		if err != nil {
+			return err
+		}
+		h.st.extras = append(h.st.extras, x)
+	}
+	return nil
+}
+
+// reconfigureExtraFormats reconfigures the handlers writing
+// the ExtraFormat formats after the main handler.
+func (h handler) reconfigureExtraFormats() error {
+	var errs []error
+	for i, x := range h.st.extras {
+		cnf := h.extraConfig(*h.cnf, h.cnf.extraFormats[i])
+		errs = append(errs, x.Reconfigure(func(c *config) { *c = cnf }))
+	}
+	return errors.Join(errs...)
+}
+
+// handleExtraFormats passes r to the handlers of the ExtraFormat formats.
+func (h handler) handleExtraFormats(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, x := range h.extras {
+		if !x.Enabled(ctx, r.Level) {
+			continue
+		}
+		err := x.Handle(ctx, r.Clone())
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeExtraFormats closes the handlers of the ExtraFormat formats.
+func (h handler) closeExtraFormats() error {
+	var errs []error
+	for _, x := range h.st.extras {
+		errs = append(errs, x.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -5,34 +5,121 @@
 package rotoslog
 
 import (
+	"encoding/binary"
+	"errors"
+	"io"
 	"io/fs"
 	"os"
+	"runtime"
+	"time"
 )
 
+// indexEntrySize is the size of an index entry: the byte offset of a record
+// and its timestamp in nanoseconds since the epoch, both encoded as 8 byte
+// big-endian integers.
+const indexEntrySize = 16
+
 type logFile struct {
-	file *os.File
-	size int64
+	file     *os.File
+	path     string
+	size     int64
+	buf      []byte
+	bufSize  int
+	fallback io.Writer
+	index    *os.File
+	interval int64
+	next     int64
+	strict   bool
+	sync     bool
+}
+
+// SetSyncWrites makes every write to the file
+// followed by a call to Sync.
+func (f *logFile) SetSyncWrites(sync bool) {
+	f.sync = sync
+}
+
+// SetStrictMode makes files created by Open get exactly
+// the requested permissions, regardless of the umask.
+func (f *logFile) SetStrictMode(strict bool) {
+	f.strict = strict
+}
+
+// SetIndexInterval enables writing an index file alongside the log file,
+// with an entry for the first record written after each interval bytes.
+func (f *logFile) SetIndexInterval(n uint64) {
+	f.interval = int64(n)
+}
+
+// SetFallback sets the writer used for writes occurring while the file is closed.
+func (f *logFile) SetFallback(w io.Writer) {
+	f.fallback = w
+}
+
+// SetBufferSize enables buffering of up to n bytes of
+// written data, which is written to file by Flush.
+func (f *logFile) SetBufferSize(n int) {
+	f.bufSize = n
+	f.buf = make([]byte, 0, n)
 }
 
 func (f *logFile) Open(name string, flag int, perm os.FileMode) (err error) {
 	if f.file != nil {
 		return nil
 	}
-	f.file, err = os.OpenFile(name, flag, perm)
+	f.file, err = openFile(name, flag, perm, f.strict)
 	if err != nil {
 		return err
 	}
-	info, err := f.file.Stat()
+	f.path = name
+	// Seeking to the end positions the file where the next write
+	// occurs and yields its offset, which is the authoritative size
+	// even if O_APPEND is not honored.
+	f.size, err = f.file.Seek(0, io.SeekEnd)
 	if err != nil {
 		return err
 	}
-	f.size = info.Size()
+	if f.interval > 0 {
+		f.index, err = openFile(name+INDEX_FILE_EXTENSION, flag, perm, f.strict)
+		if err != nil {
+			return err
+		}
+		f.next = 0
+		if f.size > 0 {
+			f.next = (f.size/f.interval + 1) * f.interval
+		}
+	}
 	return nil
 }
 
+// IndexRecord adds an entry for a record with timestamp t to the index,
+// if the record is the first one written after an interval boundary.
+func (f *logFile) IndexRecord(t time.Time) error {
+	if f.index == nil || f.size < f.next {
+		return nil
+	}
+	var entry [indexEntrySize]byte
+	binary.BigEndian.PutUint64(entry[:8], uint64(f.size))
+	binary.BigEndian.PutUint64(entry[8:], uint64(t.UnixNano()))
+	_, err := f.index.Write(entry[:])
+	f.next = (f.size/f.interval + 1) * f.interval
+	return err
+}
+
 func (f *logFile) Close() (err error) {
-	err = f.file.Close()
+	err = f.Flush()
+	cerr := f.file.Close()
+	if err == nil {
+		err = cerr
+	}
 	f.file = nil
+	if f.index != nil {
+		cerr = f.index.Close()
+		if err == nil {
+			err = cerr
+		}
+		f.index = nil
+	}
 	return
 }
 
@@ -42,11 +129,101 @@ func (f *logFile) Stat() (info fs.FileInfo, err error) {
 }
 
 func (f *logFile) Write(p []byte) (n int, err error) {
+	if f.file == nil && f.fallback != nil {
+		return f.fallback.Write(p)
+	}
+	if f.bufSize > 0 {
+		if len(f.buf)+len(p) > f.bufSize {
+			err = f.Flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+		if len(p) <= f.bufSize {
+			f.buf = append(f.buf, p...)
+			f.size += int64(len(p))
+			return len(p), nil
+		}
+	}
 	n, err = f.file.Write(p)
 	f.size += int64(n)
+	if err == nil && f.sync {
+		err = f.file.Sync()
+	}
 	return
 }
 
+// Flush writes the buffered data to file.
+func (f *logFile) Flush() error {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	n, err := f.file.Write(f.buf)
+	f.size -= int64(len(f.buf) - n)
+	f.buf = f.buf[:0]
+	if err == nil && f.sync {
+		err = f.file.Sync()
+	}
+	return err
+}
+
+// Sync flushes the buffered data and commits the file to stable storage.
+func (f *logFile) Sync() error {
+	err := f.Flush()
+	if err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Buffered returns the number of bytes waiting to be flushed.
+func (f *logFile) Buffered() int {
+	return len(f.buf)
+}
+
+func (f *logFile) Path() string {
+	return f.path
+}
+
 func (f *logFile) Size() int64 {
 	return f.size
 }
+
+// writeFile writes data to the named file like os.WriteFile,
+// giving a file it creates exactly perm if strict is true: see openFile.
+func writeFile(name string, data []byte, perm os.FileMode, strict bool) error {
+	f, err := openFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm, strict)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openFile opens the named file like os.OpenFile. If strict is true, a file
+// created by the call is given exactly perm, regardless of the umask.
+// Strict mode is ignored on Windows, where only the read-only attribute
+// can be set.
+func openFile(name string, flag int, perm os.FileMode, strict bool) (*os.File, error) {
+	if !strict || runtime.GOOS == "windows" {
+		return os.OpenFile(name, flag, perm)
+	}
+	_, err := os.Stat(name)
+	created := errors.Is(err, fs.ErrNotExist)
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		err = file.Chmod(perm)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
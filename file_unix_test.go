@@ -0,0 +1,70 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || dragonfly
+
+package rotoslog
+
+import (
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStrictFileMode(t *testing.T) {
+	for _, umask := range []int{0o077, 0o000} {
+		dir := filepath.Join(t.TempDir(), "log")
+		old := syscall.Umask(umask)
+		h, err := NewHandler(
+			LogDir(dir),
+			DateTimeLayout("20060102150405.000000000"),
+			MaxFileSize(64),
+			WriteIndex(1),
+			WriteMetadata(true),
+			CurrentPointerFile("CURRENT"),
+			StrictFileMode(true),
+		)
+		if err != nil {
+			syscall.Umask(old)
+			t.Fatal(err)
+		}
+		logger := slog.New(h)
+		for i := 0; i < 4; i++ {
+			logger.Info("strict msg", "i", i)
+		}
+		h.Close()
+		syscall.Umask(old)
+
+		var files int
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			expected := fs.FileMode(DEFAULT_FILE_MODE)
+			if d.IsDir() {
+				expected = DEFAULT_DIR_MODE
+			} else {
+				files++
+			}
+			if info.Mode().Perm() != expected {
+				t.Fatalf("umask %03o: wrong mode of %s: got %v, expected %v", umask, path, info.Mode().Perm(), expected)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The current file, its index and the pointer file, and at least
+		// a rotated file with its index and metadata files.
+		if files < 6 {
+			t.Fatalf("umask %03o: too few files: %d", umask, files)
+		}
+	}
+}
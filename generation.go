@@ -0,0 +1,122 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// IncludeGeneration makes every handler claim, when it is created, a
+// generation number one greater than the one claimed last in the log
+// directory, which is kept in the [GENERATION_FILE_NAME] file, and insert
+// it after the file prefix of all the file names: <prefix>gen<N>-, e.g.
+// app-gen7-current.log. This tells apart the files of different runs of
+// a process sharing the log directory. The generation file is locked while
+// it is updated, except on platforms without flock. Retention only applies
+// to the rotated files of the same generation, unless RetainAcrossGenerations
+// is enabled. Reconfigure keeps the generation claimed by the handler.
+func IncludeGeneration(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.includeGeneration = enabled
+	}
+}
+
+// RetainAcrossGenerations makes retention apply to the rotated files of all
+// the generations, when IncludeGeneration is enabled, so that MaxRotatedFiles
+// and MaxAge limit the files of all the runs together.
+func RetainAcrossGenerations(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.acrossGenerations = enabled
+	}
+}
+
+// applyGeneration inserts the generation of the handler in the file prefix
+// of cnf, if IncludeGeneration is enabled, claiming one if it has none yet,
+// unless cnf carries the generation of the main handler of an ExtraFormat.
+func (h handler) applyGeneration(cnf *config) error {
+	if !cnf.includeGeneration {
+		return nil
+	}
+	if h.st.generation == 0 {
+		h.st.generation = cnf.generation
+	}
+	if h.st.generation == 0 {
+		gen, err := claimGeneration(cnf.logDir)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrOpen, err)
+		}
+		h.st.generation = gen
+	}
+	cnf.basePrefix = cnf.filePrefix
+	cnf.filePrefix += "gen" + strconv.FormatUint(h.st.generation, 10) + "-"
+	cnf._currentFilePath = ""
+	return nil
+}
+
+// claimGeneration increments the generation number
+// kept in dir, returning the new number.
+func claimGeneration(dir string) (uint64, error) {
+	err := os.MkdirAll(dir, DEFAULT_DIR_MODE)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, GENERATION_FILE_NAME), os.O_RDWR|os.O_CREATE, DEFAULT_FILE_MODE)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	err = lockFile(f)
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return 0, err
+	}
+	var gen uint64
+	if s := strings.TrimSpace(string(data)); s != "" {
+		gen, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid generation file: %w", err)
+		}
+	}
+	gen++
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.FormatUint(gen, 10)+"\n"), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return gen, nil
+}
+
+// trimFilePrefix returns name without the file prefix, and whether it has
+// it. With RetainAcrossGenerations the prefix of any generation is trimmed.
+func (cnf *config) trimFilePrefix(name string) (string, bool) {
+	if strings.HasPrefix(name, cnf.filePrefix) {
+		return name[len(cnf.filePrefix):], true
+	}
+	if !cnf.includeGeneration || !cnf.acrossGenerations {
+		return name, false
+	}
+	rest, ok := strings.CutPrefix(name, cnf.basePrefix+"gen")
+	if !ok {
+		return name, false
+	}
+	gen, rest, ok := strings.Cut(rest, "-")
+	if !ok {
+		return name, false
+	}
+	_, err := strconv.ParseUint(gen, 10, 64)
+	return rest, err == nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import "time"
+
+// Healthy implements the method of the Handler interface.
+func (h handler) Healthy() error {
+	err := h.st.health.Load()
+	if err == nil {
+		return nil
+	}
+	return *err
+}
+
+// updateHealth records the outcome of the latest operation, whose error
+// is err, as the health of the handler returned by Healthy. Being closed
+// or logging to standard error prevails over the outcome.
+func (h handler) updateHealth(err error) {
+	switch {
+	case h.st.closed:
+		err = ErrClosed
+	case h.st.degraded:
+		err = ErrDegraded
+	}
+	current := h.st.health.Load()
+	if (current == nil && err == nil) || (current != nil && *current == err) {
+		return
+	}
+	if err == nil {
+		h.st.health.Store(nil)
+		return
+	}
+	h.st.health.Store(errorPointer(err))
+}
+
+// errorPointer returns a pointer to a copy of err. Taking the address of
+// err in updateHealth would move it to the heap on every call.
+func errorPointer(err error) *error {
+	return &err
+}
+
+// fileOpening records when the current log file was opened, together with
+// the clock to measure its age with, so that CurrentFileAge can read both
+// without the handler lock.
+type fileOpening struct {
+	at    time.Time
+	clock func() time.Time
+}
+
+// CurrentFileAge implements the method of the Handler interface.
+func (h handler) CurrentFileAge() time.Duration {
+	opened := h.st.opened.Load()
+	if opened == nil {
+		return 0
+	}
+	return opened.clock().Sub(opened.at)
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// keepLate keeps the file just rotated to path open for the records
+// of its time bucket arriving within the LateWriteGrace window.
+func (h handler) keepLate(path string) {
+	h.closeLate()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		h.meta(slog.LevelWarn, "cannot keep rotated log file open", "file", path, "error", err)
+		return
+	}
+	h.st.late = f
+	h.st.lateBucket = h.st.bucketStart
+	h.st.lateUntil = h.cnf.clock().Add(h.cnf.lateWriteGrace)
+}
+
+// closeLate closes the file kept open for late records, if any.
+func (h handler) closeLate() {
+	if h.st.late == nil {
+		return
+	}
+	h.st.late.Close()
+	h.st.late = nil
+}
+
+// isLate reports whether a record with timestamp t belongs to the time
+// bucket of the file kept open for late records, closing the file once
+// the grace window is over.
+func (h handler) isLate(t time.Time) bool {
+	if h.cnf.clock().After(h.st.lateUntil) {
+		h.closeLate()
+		return false
+	}
+	return !t.Before(h.st.lateBucket) && t.Before(h.st.bucketStart)
+}
+
+// writeLate appends a late record to the file of its time bucket.
+func (h handler) writeLate(ctx context.Context, r slog.Record) error {
+	err := h.format(ctx, r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	if h.buf.Len() == 0 {
+		return nil
+	}
+	n, err := h.st.late.Write(h.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	h.st.intervalStats.Records++
+	h.st.intervalStats.Bytes += uint64(n)
+	return nil
+}
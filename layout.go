@@ -0,0 +1,51 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"fmt"
+	"time"
+)
+
+// layoutReference is the time formatted and parsed back to check
+// DateTimeLayout: all its fields differ, so that a layout dropping or
+// confusing any of them does not round-trip.
+var layoutReference = time.Date(2023, 11, 22, 13, 44, 55, 666777888, time.Local)
+
+// CheckDateTimeLayout makes NewHandler and Reconfigure reject the
+// DateTimeLayout values that do not round-trip, on which MaxAge, the
+// ordering of rotated files and ArchiveBundle silently break: a formatted
+// timestamp must parse back to the same date, losing less than the
+// rotation granularity. The granularity is RotateEvery if set, otherwise
+// MinRotationInterval if set, otherwise one second.
+func CheckDateTimeLayout(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.checkLayout = enabled
+	}
+}
+
+// checkDateTimeLayout verifies that the date time layout round-trips.
+func (cnf *config) checkDateTimeLayout() error {
+	s := layoutReference.Format(cnf.dateTimeLayout)
+	t, err := time.ParseInLocation(cnf.dateTimeLayout, s, time.Local)
+	if err != nil {
+		return fmt.Errorf("%w: date time layout %q cannot be parsed: %v", ErrInvalidConfig, cnf.dateTimeLayout, err)
+	}
+	y, m, d := t.Date()
+	ry, rm, rd := layoutReference.Date()
+	if y != ry || m != rm || d != rd {
+		return fmt.Errorf("%w: date time layout %q loses the date", ErrInvalidConfig, cnf.dateTimeLayout)
+	}
+	granularity := time.Second
+	if cnf.rotateEvery > 0 {
+		granularity = cnf.rotateEvery
+	} else if cnf.minRotationGap > 0 {
+		granularity = cnf.minRotationGap
+	}
+	if loss := layoutReference.Sub(t); loss < 0 || loss >= granularity {
+		return fmt.Errorf("%w: date time layout %q is coarser than %v", ErrInvalidConfig, cnf.dateTimeLayout, granularity)
+	}
+	return nil
+}
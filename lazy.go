@@ -0,0 +1,52 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// lazyFormatter is the formatter of a handler with LazyFormatter enabled,
+// building the actual formatter on the first call of any of its methods.
+type lazyFormatter struct {
+	once    sync.Once
+	build   func() slog.Handler
+	handler slog.Handler
+}
+
+// get returns the actual formatter, building it on the first call.
+func (f *lazyFormatter) get() slog.Handler {
+	f.once.Do(func() {
+		f.handler = f.build()
+		f.build = nil
+	})
+	return f.handler
+}
+
+func (f *lazyFormatter) Enabled(ctx context.Context, level slog.Level) bool {
+	return f.get().Enabled(ctx, level)
+}
+
+func (f *lazyFormatter) Handle(ctx context.Context, r slog.Record) error {
+	return f.get().Handle(ctx, r)
+}
+
+func (f *lazyFormatter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return f.get().WithAttrs(attrs)
+}
+
+func (f *lazyFormatter) WithGroup(name string) slog.Handler {
+	return f.get().WithGroup(name)
+}
+
+// unwrapFormatter returns the actual formatter behind f.
+func unwrapFormatter(f slog.Handler) slog.Handler {
+	if lf, ok := f.(*lazyFormatter); ok {
+		return lf.get()
+	}
+	return f
+}
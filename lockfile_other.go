@@ -0,0 +1,14 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package rotoslog
+
+import "os"
+
+// lockFile does nothing on the platforms without flock.
+func lockFile(f *os.File) error {
+	return nil
+}
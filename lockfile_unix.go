@@ -0,0 +1,17 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || dragonfly
+
+package rotoslog
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile locks f exclusively until it is closed.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
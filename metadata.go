@@ -0,0 +1,56 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// metadataSchemaVersion is the version of the layout of metadata files.
+const metadataSchemaVersion = 1
+
+// fileMetadata is the content of the metadata sidecar file of a rotated file.
+type fileMetadata struct {
+	StartTime     *time.Time `json:"startTime,omitempty"`
+	EndTime       *time.Time `json:"endTime,omitempty"`
+	RecordCount   uint64     `json:"recordCount"`
+	Bytes         int64      `json:"bytes"`
+	Hostname      string     `json:"hostname"`
+	PID           int        `json:"pid"`
+	SchemaVersion int        `json:"schemaVersion"`
+}
+
+// writeMetadataFile atomically writes the metadata sidecar file of the
+// rotated file at path, whose size is size, describing the current file.
+func (h handler) writeMetadataFile(path string, size int64) error {
+	md := fileMetadata{
+		RecordCount:   h.st.fileRecords,
+		Bytes:         size,
+		PID:           os.Getpid(),
+		SchemaVersion: metadataSchemaVersion,
+	}
+	if !h.st.firstRecordTime.IsZero() {
+		md.StartTime = &h.st.firstRecordTime
+	}
+	if !h.st.lastRecordTime.IsZero() {
+		md.EndTime = &h.st.lastRecordTime
+	}
+	md.Hostname, _ = os.Hostname()
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	// The temporary name keeps the extension, so that it is never
+	// mistaken for a rotated file.
+	metaPath := path + METADATA_FILE_EXTENSION
+	tmpPath := path + ".tmp" + METADATA_FILE_EXTENSION
+	err = writeFile(tmpPath, data, DEFAULT_FILE_MODE, h.cnf.strictFileMode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, metaPath)
+}
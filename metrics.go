@@ -0,0 +1,46 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import "time"
+
+// MetricsCollector receives the measurements of the activity of a handler
+// as they happen, for integration with metrics backends such as Prometheus
+// or OpenTelemetry. Its methods are called synchronously, with the handler
+// lock held, so they must be fast and must not log through the handler.
+type MetricsCollector interface {
+	// RecordWrite is called for every record written to the current log
+	// file, with its size in bytes and the time taken to format and write it.
+	RecordWrite(bytes int, d time.Duration)
+	// RecordRotation is called after every successful rotation of the
+	// current log file, with the time taken by the rotation, including
+	// retention and the opening of the new current file.
+	RecordRotation(reason RotationReason, d time.Duration)
+	// RecordDrop is called for every record dropped, with the reason:
+	// "rateLimit", "filtered", "error" or "deferred", as reported by
+	// SummaryInterval.
+	RecordDrop(reason string)
+	// RecordError is called with every error reported to OnError.
+	RecordError(err error)
+}
+
+// WithMetrics sets a MetricsCollector receiving the measurements of the
+// handler activity, pushing them where Stats has to be polled. Measuring
+// the write durations costs two clock readings per record. With
+// ExtraFormat only the main set of files is measured, so that every record
+// is counted once.
+func WithMetrics(collector MetricsCollector) optFun {
+	return func(cnf *config) {
+		cnf.metrics = collector
+	}
+}
+
+// recordRotation reports to the MetricsCollector the rotation because
+// of reason started at start, unless it failed with *err.
+func (h handler) recordRotation(reason RotationReason, start time.Time, err *error) {
+	if *err == nil {
+		h.cnf.metrics.RecordRotation(reason, time.Since(start))
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// NumberedRotation names the rotated files with numbers instead of
+// timestamps, logrotate style: <prefix>1<extension> is the newest rotated
+// file and <prefix>N<extension>, where N is MaxRotatedFiles, the oldest.
+// Like the timestamp, the number directly follows the prefix, which must
+// end with a separator to get logrotate names: FilePrefix("app.") gives
+// app.1.log, while FilePrefix("app") gives app1.log and the default empty
+// prefix 1.log.
+// On rotation every rotated file is renamed to the next number, the oldest
+// one is removed and the current file becomes number 1, so the layout is
+// deterministic and independent of the clock. MaxAge and the other options
+// choosing the rotated file names or moving them do not apply.
+// NumberedRotation cannot be combined with RingFiles, DailyFileIsCurrent,
+// CurrentNameFunc, PerProcessCurrent, WithRotatedSink, RotatedNameFunc,
+// WithEncryption and ArchiveBundle.
+func NumberedRotation(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.numbered = enabled
+	}
+}
+
+// checkNumbered verifies that no option incompatible
+// with NumberedRotation is set.
+func (cnf *config) checkNumbered() error {
+	if cnf.ringFiles || cnf.timeNamedCurrent() || cnf.perProcessCurrent || cnf.rotatedSink != nil ||
+		cnf.rotatedNameFunc != nil || cnf.encryptionKey != nil || cnf.bundle {
+		return fmt.Errorf("%w: NumberedRotation excludes RingFiles, DailyFileIsCurrent, CurrentNameFunc, PerProcessCurrent, WithRotatedSink, RotatedNameFunc, WithEncryption and ArchiveBundle", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// numberedFilePath returns the path of the i-th numbered rotated file.
+func (cnf *config) numberedFilePath(i uint64) string {
+	return cnf.filePath(cnf.filePrefix + strconv.FormatUint(i, 10) + cnf.fileExtension)
+}
+
+// rotateNumbered shifts the numbered rotated files, removing the
+// oldest one, and renames the current log file to the first number.
+func (h handler) rotateNumbered(reason RotationReason) error {
+	err := h.finishFile()
+	if err != nil {
+		return err
+	}
+	size := h.w.Size()
+	err = h.w.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClose, err)
+	}
+	oldest := h.cnf.numberedFilePath(h.cnf.maxRotatedFiles)
+	err = os.Remove(oldest)
+	if err == nil {
+		err = removeSidecars(oldest)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrCleanup, err)
+	}
+	for i := h.cnf.maxRotatedFiles - 1; i >= 1; i-- {
+		err = renameWithSidecars(h.cnf.numberedFilePath(i), h.cnf.numberedFilePath(i+1))
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrRotateRename, err)
+		}
+	}
+	currentFilePath := h.cnf.currentFilePath()
+	rotatedFilePath := h.cnf.numberedFilePath(1)
+	err = renameWithSidecars(currentFilePath, rotatedFilePath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRotateRename, err)
+	}
+	if h.cnf.writeMetadata {
+		err = h.writeMetadataFile(rotatedFilePath, size)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrWrite, err)
+		}
+	}
+	h.meta(slog.LevelInfo, "rotated log file", "from", currentFilePath, "to", rotatedFilePath)
+	h.emitEvent(reason, currentFilePath, rotatedFilePath, size)
+
+	return h.startFile(reason, filepath.Base(rotatedFilePath))
+}
+
+// renameWithSidecars renames the log file at from, and its sidecar
+// files, to to, skipping the files that do not exist.
+func renameWithSidecars(from, to string) error {
+	for _, ext := range append([]string{""}, sidecarExtensions...) {
+		err := os.Rename(from+ext, to+ext)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
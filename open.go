@@ -0,0 +1,75 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// OpenRotated opens the rotated file at path for reading, undoing the
+// transformations named by its extensions from the last one: files with
+// the [ENCRYPTED_FILE_EXTENSION] extension are decrypted with the key
+// returned by the key provider set with WithEncryption, and files with the
+// [GZIP_FILE_EXTENSION] extension are decompressed, so that the reader of
+// a file named like "app.log.gz.enc" yields the original records. Other
+// options are ignored.
+func OpenRotated(path string, opts ...optFun) (io.ReadCloser, error) {
+	cnf := defaultConfig
+	for _, opt := range opts {
+		opt(&cnf)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	for name := filepath.Base(path); ; name = name[:len(name)-len(filepath.Ext(name))] {
+		switch filepath.Ext(name) {
+		case ENCRYPTED_FILE_EXTENSION:
+			r, err = decryptReader(r, &cnf)
+		case GZIP_FILE_EXTENSION:
+			r, err = gzip.NewReader(r)
+		default:
+			return readCloser{r, f}, nil
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+}
+
+// decryptReader returns a reader of the plaintext of the encrypted
+// content read from r, decrypted with the key provider of cnf.
+func decryptReader(r io.Reader, cnf *config) (io.Reader, error) {
+	if cnf.encryptionKey == nil {
+		return nil, errors.New("rotoslog: no key provider for encrypted log file")
+	}
+	key, err := cnf.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(data, key)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(plaintext), nil
+}
+
+// readCloser reads from the outermost reader of a
+// transformation chain and closes the underlying file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,100 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"log/slog"
+	"time"
+)
+
+// rateLimitMaxKeys is the number of keys tracked by RateLimitPerKey beyond
+// which the keys whose bucket is full again are forgotten.
+const rateLimitMaxKeys = 10000
+
+// tokenBucket is the rate limiter of a RateLimitPerKey key.
+type tokenBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed uint64
+}
+
+// RateLimitPerKey limits the records sharing the value of the attribute
+// with the given key to rate records per second, with bursts of up to burst
+// records, so that a misbehaving loop cannot flood the log files and the
+// rotations. If key is empty or [slog.MessageKey] records are keyed by their
+// message. Only the attributes of the record are looked up, not the ones
+// added with WithAttrs; records without the attribute are not limited.
+// Records over the limit are dropped and counted in Stats as Suppressed;
+// when the next record with the same key is written, the number of records
+// suppressed meanwhile is reported to the MetaLogger.
+// If rate is 0 no limit applies.
+func RateLimitPerKey(key string, rate, burst int) optFun {
+	return func(cnf *config) {
+		cnf.rateLimitKey = key
+		cnf.rateLimit = rate
+		cnf.rateLimitBurst = burst
+	}
+}
+
+// rateLimitValue returns the value keying r for RateLimitPerKey,
+// and whether r has one.
+func (cnf *config) rateLimitValue(r slog.Record) (value string, found bool) {
+	if cnf.rateLimitKey == "" || cnf.rateLimitKey == slog.MessageKey {
+		return r.Message, true
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == cnf.rateLimitKey {
+			value, found = a.Value.String(), true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// allow reports whether r is within the RateLimitPerKey limit of its key,
+// taking a token from the bucket of the key if it is.
+func (h handler) allow(r slog.Record) bool {
+	key, ok := h.cnf.rateLimitValue(r)
+	if !ok {
+		return true
+	}
+	now := h.cnf.clock()
+	burst := float64(h.cnf.rateLimitBurst)
+	b := h.st.buckets[key]
+	if b == nil {
+		if len(h.st.buckets) >= rateLimitMaxKeys {
+			h.pruneBuckets(now)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		h.st.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(burst, b.tokens+elapsed.Seconds()*float64(h.cnf.rateLimit))
+		b.last = now
+	}
+	if b.tokens < 1 {
+		b.suppressed++
+		h.st.intervalStats.Suppressed++
+		return false
+	}
+	b.tokens--
+	if b.suppressed > 0 {
+		h.meta(slog.LevelWarn, "records suppressed", "key", key, "count", b.suppressed)
+		b.suppressed = 0
+	}
+	return true
+}
+
+// pruneBuckets forgets the keys whose bucket would be full at now
+// and which have no suppressed records left to report.
+func (h handler) pruneBuckets(now time.Time) {
+	burst := float64(h.cnf.rateLimitBurst)
+	for key, b := range h.st.buckets {
+		if b.suppressed == 0 && b.tokens+now.Sub(b.last).Seconds()*float64(h.cnf.rateLimit) >= burst {
+			delete(h.st.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// FramingMode is the type of the constants used to select
+// how records are delimited in log files.
+type FramingMode int
+
+const (
+	// Newline writes records as produced by the formatter,
+	// which for the standard handlers means one record per line.
+	Newline FramingMode = iota
+	// LengthPrefix precedes every record with its length
+	// in bytes, encoded as a 4 byte big-endian integer.
+	LengthPrefix
+)
+
+const lengthPrefixSize = 4
+
+// capturesRecords reports whether the formatter output must be
+// collected in a buffer and processed before being written to file.
+func (cnf *config) capturesRecords() bool {
+	return cnf.trailingNewline || cnf.oversizedPolicy != OversizedWrite || cnf.framing != Newline || cnf.lineNumbering || cnf.singleLine || cnf.liveTail ||
+		cnf.lateWriteGrace > 0 || cnf.deferredPersist > 0 ||
+		cnf.writeAttempts > 1
+}
+
+// framingOverhead returns the number of bytes
+// added by the framing to every record.
+func (cnf *config) framingOverhead() int64 {
+	if cnf.framing == LengthPrefix {
+		return lengthPrefixSize
+	}
+	return 0
+}
+
+// format writes the formatted record to the handler buffer,
+// applying the configured framing, line numbering and newline guards.
+func (h handler) format(ctx context.Context, r slog.Record) error {
+	h.buf.Reset()
+	if h.cnf.framing == LengthPrefix {
+		h.buf.Write(make([]byte, lengthPrefixSize))
+	}
+	if h.cnf.lineNumbering {
+		fmt.Fprintf(h.buf, "%06d| ", h.st.fileRecords+1)
+	}
+	n := h.buf.Len()
+	err := h.formatter.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+	if h.buf.Len() == n {
+		// The formatter dropped the record: nothing must be written.
+		h.buf.Reset()
+		return nil
+	}
+	if h.cnf.trailingNewline {
+		h.ensureTrailingNewline(n)
+	}
+	if h.cnf.singleLine {
+		h.makeSingleLine(n)
+	}
+	if h.cnf.framing == LengthPrefix {
+		b := h.buf.Bytes()
+		binary.BigEndian.PutUint32(b, uint32(len(b)-lengthPrefixSize))
+	}
+	return nil
+}
+
+// ensureTrailingNewline makes the record formatted in the handler
+// buffer from offset end with exactly one newline.
+func (h handler) ensureTrailingNewline(offset int) {
+	record := h.buf.Bytes()[offset:]
+	body := bytes.TrimRight(record, "\n")
+	if len(body) == len(record)-1 {
+		return
+	}
+	h.buf.Truncate(offset + len(body))
+	h.buf.WriteByte('\n')
+}
+
+// makeSingleLine escapes the newlines within the record formatted in the
+// handler buffer from offset, and makes sure the record ends with a newline.
+func (h handler) makeSingleLine(offset int) {
+	record := h.buf.Bytes()[offset:]
+	body := bytes.TrimSuffix(record, []byte{'\n'})
+	if bytes.IndexByte(body, '\n') >= 0 {
+		body = bytes.ReplaceAll(body, []byte{'\n'}, []byte(`\n`))
+		h.buf.Truncate(offset)
+		h.buf.Write(body)
+		h.buf.WriteByte('\n')
+		return
+	}
+	if len(body) == len(record) {
+		h.buf.WriteByte('\n')
+	}
+}
+
+// countsRecords reports whether the records already in
+// resumed files must be counted.
+func (cnf *config) countsRecords() bool {
+	return cnf.writeTrailer || cnf.lineNumbering || cnf.rotatedNameFunc != nil || cnf.writeMetadata
+}
+
+// The messages of the records written by the handler itself,
+// which are not counted among the records of a file.
+const (
+	headerMessage    = "rotoslog header"
+	trailerMessage   = "rotoslog trailer"
+	carryOverMessage = "rotoslog carry-over"
+	summaryMessage   = "suppressed records"
+)
+
+// isOwnRecord reports whether the formatted record
+// was written by the handler itself.
+func isOwnRecord(record []byte) bool {
+	for _, msg := range []string{headerMessage, trailerMessage, carryOverMessage, summaryMessage} {
+		if bytes.Contains(record, []byte(msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// countRecords returns the number of complete records in the log file at
+// path, written with the given framing, and how many of them were written
+// by the handler itself. A partial last record, left by a crash, is not
+// counted.
+func countRecords(path string, framing FramingMode) (n, own uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if framing == LengthPrefix {
+		var prefix [lengthPrefixSize]byte
+		var record []byte
+		for {
+			_, err = io.ReadFull(r, prefix[:])
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return n, own, nil
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			size := int(binary.BigEndian.Uint32(prefix[:]))
+			if cap(record) < size {
+				record = make([]byte, size)
+			}
+			record = record[:size]
+			_, err = io.ReadFull(r, record)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return n, own, nil
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			n++
+			if isOwnRecord(record) {
+				own++
+			}
+		}
+	}
+
+	var long []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			long = append(long, line...)
+			continue
+		}
+		if err == io.EOF {
+			return n, own, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if len(long) > 0 {
+			line = append(long, line...)
+			long = long[:0]
+		}
+		n++
+		if isOwnRecord(line) {
+			own++
+		}
+	}
+}
+
+// OversizedPolicy is the type of the constants selecting how records
+// larger than MaxFileSize are handled.
+type OversizedPolicy int
+
+const (
+	// OversizedWrite writes oversized records to the current log file
+	// like any other record, so that the file exceeds MaxFileSize.
+	OversizedWrite OversizedPolicy = iota
+	// OversizedDivert appends oversized records to the oversized file,
+	// named after the FilePrefix, [OVERSIZED_FILE_SUFFIX] and FileExt,
+	// which is neither rotated nor removed by the handler.
+	OversizedDivert
+	// OversizedTruncate cuts oversized records to MaxFileSize bytes,
+	// keeping their framing: with Newline framing the last byte kept
+	// is replaced by a newline.
+	OversizedTruncate
+)
+
+// oversized reports whether the record formatted in the
+// handler buffer is larger than MaxFileSize.
+func (h handler) oversized() bool {
+	return h.cnf.oversizedPolicy != OversizedWrite && h.cnf.maxFileSize > 0 &&
+		uint64(h.buf.Len()) > h.cnf.maxFileSize
+}
+
+// truncateRecord cuts the record formatted in the handler buffer to MaxFileSize bytes.
+func (h handler) truncateRecord() {
+	h.buf.Truncate(int(h.cnf.maxFileSize))
+	b := h.buf.Bytes()
+	switch h.cnf.framing {
+	case Newline:
+		b[len(b)-1] = '\n'
+	case LengthPrefix:
+		if len(b) >= lengthPrefixSize {
+			binary.BigEndian.PutUint32(b, uint32(len(b)-lengthPrefixSize))
+		}
+	}
+}
+
+// divertRecord appends the record formatted in the handler buffer to the oversized file.
+func (h handler) divertRecord() error {
+	path := h.cnf.filePath(h.cnf.oversizedFileName())
+	f, err := openFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, DEFAULT_FILE_MODE, h.cnf.strictFileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(h.buf.Bytes())
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// registry tracks the current log files of the open handlers of the
+// process, to detect handlers writing to the same files.
+var registry = struct {
+	sync.Mutex
+	handlers map[string]int
+}{handlers: map[string]int{}}
+
+// registryKey returns the key identifying the log files of cnf in the
+// registry: the absolute path of the current file, or its date or slot
+// independent part for date based current files and rings of files.
+func (cnf *config) registryKey() (string, error) {
+	dir, err := filepath.Abs(cnf.logDir)
+	if err != nil {
+		return "", err
+	}
+	name := cnf.currentFileName()
+	if cnf.timeNamedCurrent() {
+		name = cnf.filePrefix + "*" + cnf.fileExtension
+	} else if cnf.ringFiles {
+		name = cnf.filePrefix + RING_SLOT_SUFFIX + "*" + cnf.fileExtension
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// register adds the log files of cnf to the registry, failing if
+// other handlers use them and the DuplicateError policy is set.
+func register(cnf *config) (string, error) {
+	key, err := cnf.registryKey()
+	if err != nil {
+		return "", err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+
+	if registry.handlers[key] > 0 && cnf.onDuplicatePath == DuplicateError {
+		return "", fmt.Errorf("%w: %s", ErrPathInUse, key)
+	}
+	registry.handlers[key]++
+	return key, nil
+}
+
+// unregister removes a handler using the log files identified by key from the registry.
+func unregister(key string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.handlers[key]--
+	if registry.handlers[key] <= 0 {
+		delete(registry.handlers, key)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffixes of the temporary files written while a rotated file
+// is processed, left behind if the process crashes meanwhile.
+const (
+	metadataTempSuffix   = ".tmp" + METADATA_FILE_EXTENSION
+	encryptionTempSuffix = ENCRYPTED_FILE_EXTENSION + ".tmp"
+)
+
+// repairLogDirs repairs the inconsistent states of the log directories
+// left by a crash during a rotation: it removes stale temporary files,
+// finishes interrupted encryptions and removes the sidecar files of a
+// missing current file, which is then recreated by openLogFile.
+func (h handler) repairLogDirs() error {
+	for i := 0; ; i++ {
+		dir := h.cnf.spillDir(i)
+		entries, err := os.ReadDir(dir)
+		if i > 0 && errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		err = h.repairLogDir(dir, entries)
+		if err != nil {
+			return err
+		}
+		if h.cnf.maxFilesPerDir <= 0 {
+			break
+		}
+	}
+
+	path := h.cnf.currentFilePath()
+	_, err := os.Stat(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	n, err := h.countRotatedFilesIn(h.cnf.logDir)
+	if err != nil || n == 0 {
+		return err
+	}
+	h.meta(slog.LevelWarn, "current log file missing, recreating it", "path", path)
+	return removeSidecars(path)
+}
+
+// repairLogDir repairs the files of dir, whose entries are entries.
+func (h handler) repairLogDir(dir string, entries []fs.DirEntry) error {
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case strings.HasSuffix(name, metadataTempSuffix):
+			err := h.removeStaleFile(path)
+			if err != nil {
+				return err
+			}
+		case strings.HasSuffix(name, encryptionTempSuffix):
+			// The rotated file is removed only after the encrypted one
+			// is in place, so that it is still whole.
+			err := h.removeStaleFile(path)
+			if err != nil {
+				return err
+			}
+			plainPath := strings.TrimSuffix(path, encryptionTempSuffix)
+			if h.cnf.encryptionKey == nil || !names[filepath.Base(plainPath)] {
+				continue
+			}
+			_, err = encryptFile(h.cnf.encryptionKey, plainPath, h.cnf.strictFileMode)
+			if err != nil {
+				h.meta(slog.LevelWarn, "cannot encrypt rotated log file", "path", plainPath, "error", err)
+				continue
+			}
+			h.meta(slog.LevelInfo, "encrypted rotated log file", "path", plainPath)
+		case strings.HasSuffix(name, ENCRYPTED_FILE_EXTENSION):
+			plainName := strings.TrimSuffix(name, ENCRYPTED_FILE_EXTENSION)
+			if !h.cnf.isRotatedFileName(plainName) {
+				continue
+			}
+			err := h.finishEncryption(filepath.Join(dir, plainName), names[plainName])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeStaleFile removes the stale temporary file at path.
+func (h handler) removeStaleFile(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	h.meta(slog.LevelInfo, "removed stale temporary file", "path", path)
+	return nil
+}
+
+// finishEncryption completes the encryption of the rotated file at path,
+// if it was interrupted after the encrypted file was written, removing
+// the rotated file, if exists is true, and renaming its sidecar files.
+func (h handler) finishEncryption(path string, exists bool) error {
+	finished := exists
+	if exists {
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ext := range sidecarExtensions {
+		err := os.Rename(path+ext, path+ENCRYPTED_FILE_EXTENSION+ext)
+		if err == nil {
+			finished = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if finished {
+		h.meta(slog.LevelInfo, "finished interrupted encryption of rotated log file", "path", path)
+	}
+	return nil
+}
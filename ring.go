@@ -0,0 +1,115 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// checkRing verifies that no option incompatible with RingFiles is set.
+func (cnf *config) checkRing() error {
+	if cnf.timeNamedCurrent() || cnf.perProcessCurrent || cnf.publishOnComplete || cnf.rotatedSink != nil {
+		return fmt.Errorf("%w: RingFiles excludes DailyFileIsCurrent, CurrentNameFunc, PerProcessCurrent, PublishOnComplete and WithRotatedSink", ErrInvalidConfig)
+	}
+	return nil
+}
+
+// ringSlotName returns the name of the i-th slot of the ring of files.
+func (cnf *config) ringSlotName(i uint64) string {
+	return cnf.filePrefix + RING_SLOT_SUFFIX + strconv.FormatUint(i, 10) + cnf.fileExtension
+}
+
+// ringIndexPath returns the path of the file holding the number of the
+// slot of the ring of files being written, which is the newest one.
+func (cnf *config) ringIndexPath() string {
+	return cnf.filePath(cnf.filePrefix + RING_SLOT_SUFFIX + RING_INDEX_FILE_EXTENSION)
+}
+
+// loadRingSlot sets the slot being written to the one recorded in
+// the ring index file, or to the first one if there is no index file.
+func (cnf *config) loadRingSlot() error {
+	cnf.ringSlot = 0
+	cnf._currentFilePath = ""
+	data, err := os.ReadFile(cnf.ringIndexPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slot, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid ring index file: %w", err)
+	}
+	if slot < cnf.maxRotatedFiles {
+		cnf.ringSlot = slot
+	}
+	return nil
+}
+
+// prepareRing loads the slot being written and
+// creates the missing slots of the ring of files.
+func (cnf *config) prepareRing() error {
+	err := cnf.loadRingSlot()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrOpen, err)
+	}
+	for i := uint64(0); i < cnf.maxRotatedFiles; i++ {
+		path := cnf.filePath(cnf.ringSlotName(i))
+		_, err := os.Lstat(path)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%w: %w", ErrOpen, err)
+		}
+		f, err := openFile(path, os.O_CREATE|os.O_WRONLY, DEFAULT_FILE_MODE, cnf.strictFileMode)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrOpen, err)
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// rotateRing moves writing to the next slot of the ring of files,
+// truncating it, instead of renaming the current log file.
+func (h handler) rotateRing(reason RotationReason) error {
+	err := h.finishFile()
+	if err != nil {
+		return err
+	}
+	size := h.w.Size()
+	err = h.w.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClose, err)
+	}
+	from := h.cnf.currentFilePath()
+	h.cnf.ringSlot = (h.cnf.ringSlot + 1) % h.cnf.maxRotatedFiles
+	h.cnf._currentFilePath = ""
+	path := h.cnf.currentFilePath()
+	err = writeFile(h.cnf.ringIndexPath(), []byte(strconv.FormatUint(h.cnf.ringSlot, 10)), DEFAULT_FILE_MODE, h.cnf.strictFileMode)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	err = os.Truncate(path, 0)
+	if err == nil {
+		err = removeSidecars(path)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrCleanup, err)
+	}
+	h.meta(slog.LevelInfo, "rotated log file", "from", from, "to", path)
+	h.emitEvent(reason, from, from, size)
+
+	return h.startFile(reason, filepath.Base(from))
+}
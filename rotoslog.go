@@ -9,26 +9,117 @@ When creating a new handler the user can set various options:
   - [LogDir]: directory where log files are created (default: "log")
   - [FilePrefix]: file name <prefix> (default: "")
   - [CurrentFileSuffix]: current file name <suffix> (default : "current")
+  - [PublishOnComplete]: write the current file under a hidden temporary name, so that only complete files are visible (default: false)
+  - [ArchiveBundle]: bundle the rotated files of every completed period in a compressed tar archive (default: disabled)
+  - [DirReadBatch]: number of directory entries read at once when scanning the log directories (default: [DEFAULT_DIR_READ_BATCH])
+  - [RingFiles]: write to a ring of MaxRotatedFiles preallocated files, reused in turn instead of being created and removed (default: false)
+  - [PerProcessCurrent]: add the process ID to the current file name, so that every process writes its own (default: false)
   - [FileExt]: file <extension> (default: ".log")
   - [DateTimeLayout]: <timestamp> layout to be used in calls to [time.Time.Format] (default: "20060102150405")
   - [MaxFileSize]: size threshold that triggers rotation (default: 32M)
+  - [OversizedRecordPolicy]: how records larger than MaxFileSize are handled (default: [OversizedWrite])
   - [MaxRotatedFiles]: number of rotated files to keep (default: 8)
+  - [CleanupSchedule]: number of rotations or time between two applications of the retention limits (default: every rotation)
+  - [MaxAge]: maximum age of rotated files, based on the timestamp in their names (default: unlimited)
   - [HandlerOptions]: [slog.HandlerOptions] (default: zero value)
   - [LogHandlerBuilder]: a function that can build a slog.Handler used for formatting log data (default: [NewJSONHandler])
+  - [WrapHandler]: a simpler alternative to LogHandlerBuilder, building the formatting slog.Handler from the writer alone
+  - [WriteRetry]: number of write attempts and backoff between them (default: 1 attempt, no backoff)
+  - [OnError]: a function called with the errors returned by Handle (default: nil)
+  - [OverflowHandler]: a slog.Handler receiving the records that could not be written (default: nil)
+  - [LogConfigOnStart]: log the effective configuration when the handler is created (default: false)
+  - [WithFormatters]: slog-formatter formatters applied to the log data (default: none)
+  - [MinFreeBytes]: minimum free space on the log volume below which records are dropped (default: 0, disabled)
+  - [Framing]: how records are delimited in log files (default: [Newline])
+  - [LiveTail]: stream the written records to the HTTP clients of TailHandler (default: false)
+  - [EnsureTrailingNewline]: end every record with exactly one newline, whatever the formatter (default: false)
+  - [SingleLineRecords]: escape the newlines within records, so that every line of a log file is exactly one record (default: false)
+  - [LineNumbering]: precede every record with its zero-padded line number in the file (default: false)
+  - [SizeAccounting]: which bytes count toward MaxFileSize (default: [SizeAll])
+  - [DetectExternalRotation]: reopen the current file when it is renamed or removed by another process (default: false)
+  - [TimeKey]: key of the record time attribute (default: [slog.TimeKey])
+  - [TimeFormat]: layout of the record time attribute, or one of [TIME_FORMAT_UNIX] and [TIME_FORMAT_UNIX_MILLI] (default: formatter specific)
+  - [WithLevelVar]: a [slog.LevelVar] controlling the minimum level at runtime (default: nil)
+  - [LazyDerive]: apply the attributes and groups of derived loggers to the formatter on their first record (default: false)
+  - [LazyFormatter]: build the formatter when it is first needed rather than at creation (default: false)
+  - [MinRotationInterval]: minimum time between size triggered rotations (default: 0, no limit)
+  - [RotateEvery]: granularity of the wall clock aligned time buckets triggering rotation (default: 0, disabled)
+  - [SkipEmptyRotation]: do not rotate empty files at the end of time buckets (default: false)
+  - [WithEncryption]: key provider enabling the encryption of rotated files with AES-GCM (default: nil, disabled)
+  - [RepairOnStart]: repair the log directories left inconsistent by a crash during a rotation (default: false)
+  - [ProbeWrite]: make NewHandler fail if writing a probe file to the log directory fails (default: false)
+  - [LateWriteGrace]: window during which late records are appended to the file of their time bucket (default: 0, disabled)
+  - [StreamEnabled]: a function telling, from the context of each record, whether the stream is enabled (default: nil)
+  - [DailyFileIsCurrent]: name the current file after the current date, starting a new file every day (default: false)
+  - [CurrentNameFunc]: a function returning the time based part of the current file name, which is never renamed (default: nil)
+  - [CoalesceWindow]: maximum time records are buffered to be written together (default: 0, disabled)
+  - [OnClosedWrite]: what happens to records handled after Close (default: [ClosedStderr])
+  - [OnDuplicatePath]: what happens when another handler of the process writes to the same current file (default: [DuplicateAllow])
+  - [WriteIndex]: write an index of record offsets alongside each log file (default: 0, disabled)
+  - [StrictFileMode]: enforce the permissions of created files and directories regardless of the umask (default: false)
+  - [MetaLogger]: a logger receiving the handler lifecycle events, such as rotations and errors (default: nil)
+  - [SyslogMeta]: send the handler lifecycle events to the system logger (default: false)
+  - [WatchLogDir]: cache the rotated files list, tracking external changes to the log directory (default: false)
+  - [SequenceKey]: key of a sequence number attribute added to every record (default: "", disabled)
+  - [ResetSequenceOnNewFile]: restart the sequence numbers in every new log file (default: false)
+  - [TotalKey]: key of a process-wide record count attribute added to every record (default: "", disabled)
+  - [AddSource]: add the file and line of the logging call to every record, whatever the formatter (default: false)
+  - [MaxFilesPerDir]: maximum number of rotated files per directory, before spilling into <dir>.1, <dir>.2, ... (default: 0, unlimited)
+  - [WithRotatedSink]: a function returning the writer receiving the content of every rotated file, instead of renaming it (default: nil)
+  - [WriteMetadata]: write a JSON metadata sidecar file describing every rotated file (default: false)
+  - [WriteTrailer]: end every rotated file with a record reporting its record count and size (default: false)
+  - [ChainHeaders]: start every new log file with a record linking it to the file rotated before it (default: false)
+  - [CarryOverBytes]: number of bytes at the end of every rotated file repeated in a record at the start of the next file (default: 0, disabled)
+  - [SyncAbove]: minimum level of the records synced to stable storage as soon as they are written (default: disabled)
+  - [OpenSyncMode]: make every write durable by opening log files in synchronous mode (default: [SyncNone])
+  - [NameFromFirstRecord]: use the time of the first record of a file as its rotated file <timestamp> (default: false)
+  - [RotatedNameFunc]: a function choosing the rotated file names from the statistics of the rotated files (default: nil)
+  - [HardLinkLatest]: name of a hard link to the current file kept in the log directory (default: "", disabled)
+  - [CurrentPointerFile]: name of a text file holding the name of the current file kept in the log directory (default: "", disabled)
+  - [DeleteAfter]: grace period between marking a rotated file for deletion and deleting it (default: 0, immediate deletion)
+  - [ConfineToLogDir]: reject the configurations whose file names could escape the log directory (default: false)
+  - [WithClock]: the function returning the current time used for rotation decisions and file names (default: [time.Now])
+  - [MaxPause]: maximum time rotation stays suppressed by Pause (default: 0, unlimited)
+  - [FallbackToStderr]: log to standard error when the log file cannot be opened at start, switching to it when possible (default: false)
+  - [MaxPendingTasks]: maximum number of deferred deletions pending, beyond which files are deleted immediately (default: 0, unlimited)
+  - [RetentionMode]: whether the rotated files over the limits are deleted or truncated and recycled (default: [RetentionDelete])
+  - [Heartbeat]: period, level and message of a record written periodically, so that quiet periods leave a trace (default: 0, disabled)
+  - [NoLock]: disable locking, for handlers used by a single goroutine (default: locking enabled)
+  - [DeferredPersist]: buffer up to the given bytes of records in memory, written to file only if Persist is called (default: 0, disabled)
+  - [ExtraFormat]: a name suffix and a HandlerBuilder writing every record in another format to a separate set of files (default: none)
+  - [IncludeGeneration]: insert in the file names a generation number claimed by every handler at creation (default: false)
+  - [RetainAcrossGenerations]: apply retention to the rotated files of all the generations (default: false)
+  - [CheckDateTimeLayout]: reject the DateTimeLayout values whose timestamps cannot be parsed back precisely enough (default: false)
+  - [WithMetrics]: a MetricsCollector receiving the measurements of the handler activity (default: nil)
+  - [NumberedRotation]: name the rotated files 1 to MaxRotatedFiles, shifting them on rotation, instead of using timestamps (default: false)
+  - [RateLimitPerKey]: attribute key, rate per second and burst of the records allowed for every value of the key (default: 0, unlimited)
+  - [SummaryInterval]: period of the records reporting the number of records dropped (default: 0, disabled)
+  - [SyncInterval]: period of the syncs of the current file to stable storage (default: 0, disabled)
 */
 package rotoslog
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"log/slog"
+
+	formatter "github.com/samber/slog-formatter"
 )
 
 const (
@@ -48,23 +139,239 @@ const (
 	DEFAULT_MAX_FILE_SIZE       = 32 * 1024 * 1024
 	DEFAULT_MAX_ROTATED_FILES   = 8
 	DEFAULT_MAX_AGE             = time.Duration(maxInt64)
+	DEFAULT_WRITE_ATTEMPTS      = 1
+	DEFAULT_DAILY_FILE_LAYOUT   = "2006-01-02"
+	DEFAULT_COALESCE_BUFFER     = 64 * 1024
+	INDEX_FILE_EXTENSION        = ".idx"
+	METADATA_FILE_EXTENSION     = ".meta.json"
+	DELETED_FILE_EXTENSION      = ".deleted"
+	ENCRYPTED_FILE_EXTENSION    = ".enc"
+	GZIP_FILE_EXTENSION         = ".gz"
+	BUNDLE_FILE_EXTENSION       = ".tar.gz"
+	SPARE_FILE_SUFFIX           = "spare"
+	OVERSIZED_FILE_SUFFIX       = "oversized"
+	GENERATION_FILE_NAME        = "GENERATION"
+	RING_SLOT_SUFFIX            = "slot"
+	RING_INDEX_FILE_EXTENSION   = ".ring"
+	DEFAULT_DIR_READ_BATCH      = 256
+	PUBLISH_TEMP_SUFFIX         = ".tmp"
+	PROBE_FILE_PATTERN          = ".rotoslog-probe-*"
+	DEFAULT_FILE_MODE           = 0644
+	DEFAULT_DIR_MODE            = 0755
+	DEFAULT_RESCAN_INTERVAL     = time.Minute
+	DEFAULT_EVENTS_BUFFER       = 64
+	DEFAULT_TAIL_BUFFER         = 256
+)
+
+const (
+	// TIME_FORMAT_UNIX formats the record time as seconds since the epoch.
+	TIME_FORMAT_UNIX = "unix"
+	// TIME_FORMAT_UNIX_MILLI formats the record time as milliseconds since the epoch.
+	TIME_FORMAT_UNIX_MILLI = "unixmilli"
+)
+
+const (
+	// freeSpaceCheckInterval is the minimum time between two checks
+	// of the free space available on the log volume.
+	freeSpaceCheckInterval = time.Second
+	// externalRotationCheckInterval is the minimum time between two
+	// checks of the identity of the current log file.
+	externalRotationCheckInterval = time.Second
+	// fallbackRetryInterval is the minimum time between two attempts
+	// to open the log file while logging to standard error.
+	fallbackRetryInterval = time.Second
+)
+
+// Errors returned by NewHandler and Handle. Underlying errors are wrapped,
+// so both the sentinel and the original error can be matched with [errors.Is].
+var (
+	// ErrDirCreate reports a failure creating the log directory.
+	ErrDirCreate = errors.New("rotoslog: cannot create log directory")
+	// ErrOpen reports a failure opening the current log file.
+	ErrOpen = errors.New("rotoslog: cannot open log file")
+	// ErrClose reports a failure closing the current log file.
+	ErrClose = errors.New("rotoslog: cannot close log file")
+	// ErrRotateRename reports a failure renaming the current log file on rotation.
+	ErrRotateRename = errors.New("rotoslog: cannot rename log file")
+	// ErrCleanup reports a failure removing old rotated files.
+	ErrCleanup = errors.New("rotoslog: cannot remove rotated log files")
+	// ErrEncrypt reports a failure encrypting a rotated log file.
+	ErrEncrypt = errors.New("rotoslog: cannot encrypt rotated log file")
+	// ErrArchive reports a failure bundling rotated log files.
+	ErrArchive = errors.New("rotoslog: cannot bundle rotated log files")
+	// ErrNotWritable is returned by NewHandler when ProbeWrite is enabled
+	// and a probe file cannot be written to the log directory.
+	ErrNotWritable = errors.New("rotoslog: log directory not writable")
+	// ErrLink reports a failure linking the current log file
+	// or writing the CurrentPointerFile naming it.
+	ErrLink = errors.New("rotoslog: cannot link log file")
+	// ErrWrite reports a failure writing a record.
+	ErrWrite = errors.New("rotoslog: cannot write log record")
+	// ErrClosed is returned by Handle when a record is handled after Close
+	// and the ClosedError policy is set.
+	ErrClosed = errors.New("rotoslog: handler closed")
+	// ErrInvalidConfig is returned by NewHandler and Reconfigure when
+	// the configuration is not valid.
+	ErrInvalidConfig = errors.New("rotoslog: invalid configuration")
+	// ErrPathInUse is returned by NewHandler and Reconfigure when the
+	// DuplicateError policy is set and another handler of the process
+	// writes to the same current log file.
+	ErrPathInUse = errors.New("rotoslog: log file used by another handler")
+	// ErrDegraded is returned by Healthy while the handler logs to
+	// standard error because the log file cannot be opened.
+	ErrDegraded = errors.New("rotoslog: logging to standard error")
+	// ErrLowFreeSpace is returned by Handle when a record is dropped because
+	// the free space on the log volume is below the MinFreeBytes threshold.
+	ErrLowFreeSpace = errors.New("rotoslog: free space on log volume below threshold")
 )
 
 type config struct {
 	logDir            string
 	filePrefix        string
+	basePrefix        string
+	generation        uint64
+	includeGeneration bool
+	acrossGenerations bool
 	currentFileSuffix string
+	perProcessCurrent bool
+	ringFiles         bool
+	numbered          bool
+	ringSlot          uint64
+	publishOnComplete bool
+	dirReadBatch      int
+	bundle            bool
+	bundlePeriod      BundlePeriod
+	bundleNameFunc    func(start time.Time) string
 	fileExtension     string
 	dateTimeLayout    string
+	checkLayout       bool
 	maxFileSize       uint64
 	maxRotatedFiles   uint64
+	maxAge            time.Duration
 	handlerOptions    slog.HandlerOptions
 	builder           handlerBuilder
+	writeAttempts     int
+	writeBackoff      time.Duration
+	onError           func(error)
+	logConfigOnStart  bool
+	formatters        []formatter.Formatter
+	minFreeBytes      uint64
+	framing           FramingMode
+	detectExtRotation bool
+	timeKey           string
+	timeFormat        string
+	levelVar          *slog.LevelVar
+	dailyFileCurrent  bool
+	currentNameFunc   func(now time.Time) string
+	coalesceWindow    time.Duration
+	onClosedWrite     ClosedWritePolicy
+	indexInterval     uint64
+	strictFileMode    bool
+	metaLogger        *slog.Logger
+	syslogMeta        bool
+	watchLogDir       bool
+	sequenceKey       string
+	resetSequence     bool
+	totalKey          string
+	maxFilesPerDir    int
+	noLock            bool
+	writeTrailer      bool
+	chainHeaders      bool
+	syncMode          SyncMode
+	nameFromFirst     bool
+	hardLinkLatest    string
+	currentPointer    string
+	deleteAfter       time.Duration
+	retentionMode     RetentionPolicy
+	clock             func() time.Time
+	newTicker         func(d time.Duration) (<-chan time.Time, func())
+	maxPause          time.Duration
+	fallbackToStderr  bool
+	lazyDerive        bool
+	lazyFormatter     bool
+	heartbeatInterval time.Duration
+	heartbeatLevel    slog.Level
+	heartbeatMsg      string
+	sizeAccounting    SizeAccountingMode
+	rotatedSink       func(name string) io.WriteCloser
+	lineNumbering     bool
+	syncAbove         *slog.Level
+	maxPendingTasks   int
+	singleLine        bool
+	trailingNewline   bool
+	oversizedPolicy   OversizedPolicy
+	confine           bool
+	rotatedNameFunc   func(info RotationInfo) string
+	liveTail          bool
+	onDuplicatePath   DuplicatePathPolicy
+	writeMetadata     bool
+	overflow          slog.Handler
+	extraFormats      []extraFormat
+	ownExtensionOnly  bool
+	streamEnabled     func(ctx context.Context) bool
+	rotateEvery       time.Duration
+	minRotationGap    time.Duration
+	skipEmptyRotation bool
+	lateWriteGrace    time.Duration
+	encryptionKey     func() ([]byte, error)
+	repairOnStart     bool
+	probeWrite        bool
+	deferredPersist   int
+	carryOverBytes    int
+	cleanupEvery      int
+	cleanupInterval   time.Duration
+	addSource         bool
+	rateLimitKey      string
+	rateLimit         int
+	rateLimitBurst    int
+	summaryInterval   time.Duration
+	syncInterval      time.Duration
+	metrics           MetricsCollector
 	_currentFilePath  string
 }
 
 func (cnf *config) currentFileName() string {
-	return cnf.filePrefix + cnf.currentFileSuffix + cnf.fileExtension
+	if cnf.currentNameFunc != nil {
+		return cnf.filePrefix + cnf.currentNameFunc(cnf.clock()) + cnf.fileExtension
+	}
+	if cnf.dailyFileCurrent {
+		return cnf.filePrefix + cnf.clock().Format(DEFAULT_DAILY_FILE_LAYOUT) + cnf.fileExtension
+	}
+	if cnf.ringFiles {
+		return cnf.ringSlotName(cnf.ringSlot)
+	}
+	name := cnf.filePrefix + cnf.currentFileSuffix + cnf.fileExtension
+	if cnf.perProcessCurrent {
+		name = cnf.filePrefix + cnf.currentFileSuffix + "." + strconv.Itoa(os.Getpid()) + cnf.fileExtension
+	}
+	if cnf.publishOnComplete {
+		name = "." + name + PUBLISH_TEMP_SUFFIX
+	}
+	return name
+}
+
+// isCurrentFileName reports whether name is the name of the current
+// file of the handler or, with PerProcessCurrent, of another process.
+func (cnf *config) isCurrentFileName(name string) bool {
+	if name == cnf.currentFileName() {
+		return true
+	}
+	if !cnf.perProcessCurrent || cnf.timeNamedCurrent() || cnf.ringFiles {
+		return false
+	}
+	if cnf.publishOnComplete {
+		if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, PUBLISH_TEMP_SUFFIX) {
+			return false
+		}
+		name = strings.TrimSuffix(name[1:], PUBLISH_TEMP_SUFFIX)
+	}
+	prefix := cnf.filePrefix + cnf.currentFileSuffix + "."
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, cnf.fileExtension) ||
+		len(name) <= len(prefix)+len(cnf.fileExtension) {
+		return false
+	}
+	_, err := strconv.ParseUint(name[len(prefix):len(name)-len(cnf.fileExtension)], 10, 64)
+	return err == nil
 }
 
 func (cnf *config) rotatedFileName(modTime time.Time) string {
@@ -76,7 +383,16 @@ func (cnf *config) filePath(fileName string) string {
 	return filepath.Join(cnf.logDir, fileName)
 }
 
+// timeNamedCurrent reports whether the current file name
+// depends on the time, with DailyFileIsCurrent or CurrentNameFunc.
+func (cnf *config) timeNamedCurrent() bool {
+	return cnf.dailyFileCurrent || cnf.currentNameFunc != nil
+}
+
 func (cnf *config) currentFilePath() string {
+	if cnf.timeNamedCurrent() {
+		return cnf.filePath(cnf.currentFileName())
+	}
 	if cnf._currentFilePath == "" {
 		cnf._currentFilePath = cnf.filePath(cnf.currentFileName())
 	}
@@ -87,6 +403,226 @@ func (cnf *config) rotatedFilePath(modTime time.Time) string {
 	return cnf.filePath(cnf.rotatedFileName(modTime))
 }
 
+// spillDir returns the i-th directory where rotated files are placed:
+// the log directory itself for i == 0, otherwise <logDir>.<i>.
+func (cnf *config) spillDir(i int) string {
+	if i == 0 {
+		return cnf.logDir
+	}
+	return fmt.Sprintf("%s.%d", filepath.Clean(cnf.logDir), i)
+}
+
+// rotatedFileTime returns the timestamp in a rotated file name, if
+// it can be parsed with the date time layout in the local time zone.
+func (cnf *config) rotatedFileTime(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, ENCRYPTED_FILE_EXTENSION)
+	name, ok := cnf.trimFilePrefix(name)
+	if !ok || !strings.HasSuffix(name, cnf.fileExtension) {
+		return time.Time{}, false
+	}
+	dateTimeStr := name[:len(name)-len(cnf.fileExtension)]
+	t, err := time.ParseInLocation(cnf.dateTimeLayout, dateTimeStr, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// isRotatedFileName reports whether name is the name of a rotated file.
+func (cnf *config) isRotatedFileName(name string) bool {
+	rest, hasPrefix := cnf.trimFilePrefix(name)
+	return hasPrefix &&
+		name != GENERATION_FILE_NAME &&
+		(!cnf.includeGeneration || rest != cnf.currentFileSuffix+cnf.fileExtension) &&
+		!strings.HasSuffix(name, INDEX_FILE_EXTENSION) &&
+		!strings.HasSuffix(name, METADATA_FILE_EXTENSION) &&
+		!strings.HasSuffix(name, DELETED_FILE_EXTENSION) &&
+		!cnf.isCurrentFileName(name) &&
+		name != cnf.spareFileName() &&
+		name != cnf.oversizedFileName() &&
+		(!cnf.bundle || !strings.HasSuffix(name, BUNDLE_FILE_EXTENSION)) &&
+		(!cnf.ringFiles || !strings.HasPrefix(name, cnf.filePrefix+RING_SLOT_SUFFIX)) &&
+		(cnf.hardLinkLatest == "" || (name != cnf.hardLinkLatest && name != cnf.hardLinkLatest+".tmp")) &&
+		(cnf.currentPointer == "" || (name != cnf.currentPointer && name != cnf.currentPointer+".tmp")) &&
+		(!cnf.ownExtensionOnly || strings.Contains(name, cnf.fileExtension)) &&
+		!cnf.isExtraFormatFileName(name)
+}
+
+// oversizedFileName returns the name of the file
+// receiving the records diverted by OversizedDivert.
+func (cnf *config) oversizedFileName() string {
+	return cnf.filePrefix + OVERSIZED_FILE_SUFFIX + cnf.fileExtension
+}
+
+// spareFileName returns the name of the truncated rotated
+// file kept to be recycled as the next current file.
+func (cnf *config) spareFileName() string {
+	return cnf.filePrefix + SPARE_FILE_SUFFIX + cnf.fileExtension
+}
+
+// newFormatter builds the formatter writing to out,
+// wrapped by the WithFormatters formatters, if any.
+func (cnf *config) newFormatter(out io.Writer) slog.Handler {
+	f := cnf.builder(out, cnf.formatterOptions())
+	if len(cnf.formatters) > 0 {
+		f = formatter.NewFormatterHandler(cnf.formatters...)(f)
+	}
+	return f
+}
+
+// formatterOptions returns the options passed to the HandlerBuilder,
+// extending ReplaceAttr to apply the TimeKey and TimeFormat options.
+func (cnf *config) formatterOptions() *slog.HandlerOptions {
+	opts := cnf.handlerOptions
+	if cnf.levelVar != nil {
+		opts.Level = cnf.levelVar
+	}
+	if cnf.timeKey == "" && cnf.timeFormat == "" {
+		return &opts
+	}
+	replace := opts.ReplaceAttr
+	timeKey, timeFormat := cnf.timeKey, cnf.timeFormat
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if replace != nil {
+			a = replace(groups, a)
+		}
+		if len(groups) > 0 || a.Key != slog.TimeKey || a.Value.Kind() != slog.KindTime {
+			return a
+		}
+		if timeKey != "" {
+			a.Key = timeKey
+		}
+		t := a.Value.Time()
+		switch timeFormat {
+		case "":
+		case TIME_FORMAT_UNIX:
+			a.Value = slog.Int64Value(t.Unix())
+		case TIME_FORMAT_UNIX_MILLI:
+			a.Value = slog.Int64Value(t.UnixMilli())
+		default:
+			a.Value = slog.StringValue(t.Format(timeFormat))
+		}
+		return a
+	}
+	return &opts
+}
+
+// level returns the minimum enabled level.
+func (cnf *config) level() slog.Level {
+	if cnf.levelVar != nil {
+		return cnf.levelVar.Level()
+	}
+	if cnf.handlerOptions.Level != nil {
+		return cnf.handlerOptions.Level.Level()
+	}
+	return slog.LevelInfo
+}
+
+// configureLogFile applies the settings of the log file.
+func (cnf *config) configureLogFile(w *logFile) {
+	bufSize := 0
+	if cnf.coalesceWindow > 0 {
+		bufSize = DEFAULT_COALESCE_BUFFER
+	}
+	w.SetBufferSize(bufSize)
+	w.SetIndexInterval(cnf.indexInterval)
+	w.SetStrictMode(cnf.strictFileMode)
+	_, syncWrites := openSyncFlag(cnf.syncMode)
+	w.SetSyncWrites(syncWrites)
+}
+
+// validate reports an error wrapping ErrInvalidConfig
+// if the configuration is not consistent.
+func (cnf *config) validate() error {
+	if cnf.dateTimeLayout == "" {
+		return fmt.Errorf("%w: empty date time layout", ErrInvalidConfig)
+	}
+	if cnf.clock == nil {
+		return fmt.Errorf("%w: nil clock", ErrInvalidConfig)
+	}
+	if cnf.currentFileName() == cnf.filePrefix+cnf.fileExtension {
+		return fmt.Errorf("%w: current file name %q matches rotated file names", ErrInvalidConfig, cnf.currentFileName())
+	}
+	if cnf.syncMode < SyncNone || cnf.syncMode > SyncFull {
+		return fmt.Errorf("%w: invalid sync mode %d", ErrInvalidConfig, cnf.syncMode)
+	}
+	if cnf.rateLimit < 0 || (cnf.rateLimit > 0 && cnf.rateLimitBurst < 1) {
+		return fmt.Errorf("%w: invalid rate limit %d with burst %d", ErrInvalidConfig, cnf.rateLimit, cnf.rateLimitBurst)
+	}
+	if cnf.checkLayout {
+		err := cnf.checkDateTimeLayout()
+		if err != nil {
+			return err
+		}
+	}
+	if cnf.ringFiles {
+		err := cnf.checkRing()
+		if err != nil {
+			return err
+		}
+	}
+	if cnf.numbered {
+		err := cnf.checkNumbered()
+		if err != nil {
+			return err
+		}
+	}
+	if cnf.confine {
+		return cnf.checkConfinement()
+	}
+	return nil
+}
+
+// checkConfinement verifies that all the names of the files
+// created by the handler refer to entries of the log directory.
+func (cnf *config) checkConfinement() error {
+	if cnf.maxFilesPerDir > 0 {
+		return fmt.Errorf("%w: MaxFilesPerDir places rotated files outside the log directory", ErrInvalidConfig)
+	}
+	names := []string{
+		cnf.currentFileName(),
+		cnf.rotatedFileName(time.Now()),
+		cnf.spareFileName(),
+	}
+	if cnf.hardLinkLatest != "" {
+		names = append(names, cnf.hardLinkLatest)
+	}
+	if cnf.currentPointer != "" {
+		names = append(names, cnf.currentPointer)
+	}
+	for _, name := range names {
+		if !filepath.IsLocal(name) || filepath.Base(name) != name {
+			return fmt.Errorf("%w: file name %q escapes the log directory", ErrInvalidConfig, name)
+		}
+	}
+	return nil
+}
+
+// keepFormatting copies from old the fields affecting
+// formatting, which are fixed when the handler is created.
+func (cnf *config) keepFormatting(old *config) {
+	cnf.handlerOptions = old.handlerOptions
+	cnf.builder = old.builder
+	cnf.formatters = old.formatters
+	cnf.framing = old.framing
+	cnf.timeKey = old.timeKey
+	cnf.timeFormat = old.timeFormat
+	cnf.levelVar = old.levelVar
+	cnf.lazyDerive = old.lazyDerive
+	cnf.lazyFormatter = old.lazyFormatter
+	cnf.lineNumbering = old.lineNumbering
+	cnf.singleLine = old.singleLine
+	cnf.trailingNewline = old.trailingNewline
+	cnf.oversizedPolicy = old.oversizedPolicy
+	cnf.liveTail = old.liveTail
+	cnf.lateWriteGrace = old.lateWriteGrace
+	cnf.overflow = old.overflow
+	cnf.extraFormats = old.extraFormats
+	cnf.ownExtensionOnly = old.ownExtensionOnly
+	cnf.streamEnabled = old.streamEnabled
+	cnf.deferredPersist = old.deferredPersist
+}
+
 var defaultConfig = config{
 	logDir:            DEFAULT_FILE_DIR,
 	filePrefix:        DEFAULT_FILE_NAME_PREFIX,
@@ -95,10 +631,15 @@ var defaultConfig = config{
 	dateTimeLayout:    DEFAULT_FILE_DATE_FORMAT,
 	maxFileSize:       DEFAULT_MAX_FILE_SIZE,
 	maxRotatedFiles:   DEFAULT_MAX_ROTATED_FILES,
+	maxAge:            DEFAULT_MAX_AGE,
 	handlerOptions:    slog.HandlerOptions{},
 	builder: func(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
 		return slog.NewJSONHandler(w, opts)
 	},
+	writeAttempts: DEFAULT_WRITE_ATTEMPTS,
+	clock:         time.Now,
+	newTicker:     newTicker,
+	dirReadBatch:  DEFAULT_DIR_READ_BATCH,
 }
 
 type optFun func(*config)
@@ -124,9 +665,96 @@ func CurrentFileSuffix(suffix string) optFun {
 	}
 }
 
-// FileExt sets the log file extension.
+// PublishOnComplete hides the current file from the consumers of the log
+// directory until it is complete: the current file is written under the
+// hidden temporary name .current.log.tmp, after the FilePrefix,
+// CurrentFileSuffix and FileExt, and is published only when rotation
+// renames it to its rotated file name, so that consumers such as indexers
+// ingesting all the files with the log extension never see a file still
+// being written. The current file is not published by Close, and is
+// resumed by the next handler. It does not apply to DailyFileIsCurrent.
+func PublishOnComplete(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.publishOnComplete = enabled
+	}
+}
+
+// ArchiveBundle enables bundling the rotated files of every completed period
+// in a gzip compressed tar archive, for cold storage. On the first rotation
+// of a period, the rotated files of the previous periods, aged by their
+// names or modification times, are streamed in the background to the bundle
+// of their period and removed; errors are reported to OnError and the meta
+// logger, and Close waits for bundling to finish. Bundles are named by
+// nameFunc after the start of their period, or if nameFunc is nil by the
+// FilePrefix followed by the date of the start of the period, such as 2024-01
+// for monthly bundles, and have the [BUNDLE_FILE_EXTENSION] extension; names
+// returned by nameFunc must have it too and be plain file names. Bundles are
+// written to temporary files renamed when complete. Retention applies to
+// bundles as to rotated files: they count toward MaxRotatedFiles and are
+// aged by MaxAge from the end of their period, or from their modification
+// time if named by nameFunc, and are deleted whatever the RetentionMode and
+// DeleteAfter options. Rotated files of a period arriving after its bundle
+// is written extend it.
+func ArchiveBundle(period BundlePeriod, nameFunc func(start time.Time) string) optFun {
+	return func(cnf *config) {
+		cnf.bundle = true
+		cnf.bundlePeriod = period
+		cnf.bundleNameFunc = nameFunc
+	}
+}
+
+// DirReadBatch sets the number of directory entries read at once when the
+// log directories are scanned for rotated files, which bounds the memory
+// used by the scans of large directories. Any value of n less than 1 is
+// equivalent to passing [DEFAULT_DIR_READ_BATCH].
+func DirReadBatch(n int) optFun {
+	return func(cnf *config) {
+		if n < 1 {
+			n = DEFAULT_DIR_READ_BATCH
+		}
+		cnf.dirReadBatch = n
+	}
+}
+
+// RingFiles makes the handler write to a ring of MaxRotatedFiles files, named
+// slot0.log, slot1.log and so on after the FilePrefix and FileExt, for media
+// wearing with the creation and removal of files, such as flash memory. The
+// files are created once, and on rotation writing moves to the next file of
+// the ring, which is truncated and reused, so that the previous files of the
+// ring play the role of the rotated files. The number of the file being
+// written, the newest one, is kept in the slot.ring file. MaxAge and the
+// other options renaming or removing rotated files do not apply.
+// RingFiles cannot be combined with DailyFileIsCurrent, CurrentNameFunc,
+// PerProcessCurrent, PublishOnComplete and WithRotatedSink.
+func RingFiles(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.ringFiles = enabled
+	}
+}
+
+// PerProcessCurrent adds the process ID to the name of the current file, as
+// in current.1234.log, so that the processes of a pool of workers sharing
+// the log directory write each to its own current file. Rotated files have
+// the usual names, shared by all the processes, so that retention applies
+// to the rotated files of all of them; a DateTimeLayout fine enough to tell
+// apart the rotations of different processes must be used, since a rotated
+// file overwrites any file with the same name. The current files of other
+// processes are never rotated nor removed, so Close rotates the current
+// file, if not empty, and removes it. It does not apply to DailyFileIsCurrent.
+func PerProcessCurrent(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.perProcessCurrent = enabled
+	}
+}
+
+// FileExt sets the log file extension. A dot is prepended to ext if missing,
+// so that "log" and ".log" are equivalent. An empty ext is allowed: file
+// names then end with the current file suffix or the timestamp.
 func FileExt(ext string) optFun {
 	return func(cnf *config) {
+		if ext != "" && !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
 		cnf.fileExtension = ext
 	}
 }
@@ -146,6 +774,15 @@ func MaxFileSize(size uint64) optFun {
 	}
 }
 
+// OversizedRecordPolicy sets the policy for records larger than MaxFileSize,
+// which would make the current log file exceed it even when empty.
+// Diverted records are not counted as written to the current log file.
+func OversizedRecordPolicy(policy OversizedPolicy) optFun {
+	return func(cnf *config) {
+		cnf.oversizedPolicy = policy
+	}
+}
+
 // MaxRotatedFiles sets the maximum number of rotated files.
 // When the number of rotated files exceedes this number the
 // oldest rotated file is deleted.
@@ -159,6 +796,29 @@ func MaxRotatedFiles(n uint64) optFun {
 	}
 }
 
+// CleanupSchedule makes the handler apply the retention limits, MaxRotatedFiles
+// and MaxAge, only every n rotations or when interval elapsed since they were
+// last applied, whichever comes first, instead of on every rotation. When
+// rotations are frequent and reading the log directories is expensive, this
+// trades windows with more rotated files than the limits for fewer scans.
+// The deferred cleanup also runs on Close. If both n and interval are 0 the
+// limits are applied on every rotation.
+func CleanupSchedule(n int, interval time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.cleanupEvery = n
+		cnf.cleanupInterval = interval
+	}
+}
+
+// MaxAge sets the maximum age of rotated files: on rotation, files whose
+// <timestamp> is older than d are deleted. Files whose name cannot be
+// parsed with the date time layout are aged by their modification time.
+func MaxAge(d time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.maxAge = d
+	}
+}
+
 // HandlerOptions sets the slog.HandlerOptions for the handler.
 func HandlerOptions(opts slog.HandlerOptions) optFun {
 	return func(cnf *config) {
@@ -180,157 +840,2934 @@ func LogHandlerBuilder[H slog.Handler](builder HandlerBuilder[H]) optFun {
 	}
 }
 
-type handler struct {
-	w         *logFile
-	formatter slog.Handler
-	cnf       config
-	mu        *sync.Mutex
+// WrapHandler sets a function building the slog.Handler used for formatting
+// from the rotating writer alone. It is a simpler alternative to
+// LogHandlerBuilder for custom handler stacks that are configured
+// independently, such as handlers with preset attributes or middlewares.
+// HandlerOptions, TimeKey and TimeFormat are not applied to the built
+// handler, while WithLevelVar and WithFormatters still are.
+func WrapHandler(build func(w io.Writer) slog.Handler) optFun {
+	return func(cnf *config) {
+		cnf.builder = func(w io.Writer, _ *slog.HandlerOptions) slog.Handler {
+			return build(w)
+		}
+	}
 }
 
-// NewHandler creates a new handler with the given options.
-func NewHandler(options ...optFun) (slog.Handler, error) {
-	h := handler{
-		cnf: defaultConfig,
-		mu:  &sync.Mutex{},
-		w:   &logFile{},
+// WriteRetry sets the number of attempts made to write a record
+// before giving up and the time to wait between two attempts.
+// Before each new attempt the current log file is reopened, and the
+// record is written from where the failed attempt stopped. Only the
+// errors that can go away are retried, such as a full disk or a file
+// closed behind the handler's back, not e.g. permission errors.
+// Any value of attempts less than 1 is equivalent to passing 1.
+func WriteRetry(attempts int, backoff time.Duration) optFun {
+	return func(cnf *config) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		cnf.writeAttempts = attempts
+		cnf.writeBackoff = backoff
 	}
-	for _, opt := range options {
-		opt(&h.cnf)
+}
+
+// OnError sets a function that is called with any error
+// returned by Handle, since slog.Logger silently discards them.
+// The function is called with the handler lock held,
+// so it must not log through the handler itself.
+func OnError(f func(error)) optFun {
+	return func(cnf *config) {
+		cnf.onError = f
 	}
-	err := h.mkLogDir()
-	if err != nil {
-		return nil, err
+}
+
+// OverflowHandler sets a handler receiving the records that could not be
+// written to the log files, e.g. because of write errors, low free space or
+// the ClosedError policy, so that they are not lost. The attributes and
+// groups of derived handlers are applied to it as well. Diverted records
+// are counted by Stats.
+func OverflowHandler(h slog.Handler) optFun {
+	return func(cnf *config) {
+		cnf.overflow = h
 	}
-	err = h.openLogFile()
-	if err != nil {
-		return nil, err
+}
+
+// LogConfigOnStart enables writing a record describing the effective
+// rotation settings when the handler is created.
+func LogConfigOnStart(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.logConfigOnStart = enabled
 	}
-	h.formatter = h.cnf.builder(h.w, &h.cnf.handlerOptions)
-	return h, nil
 }
 
-func (h *handler) mkLogDir() error {
-	path := h.cnf.currentFilePath()
-	return os.MkdirAll(filepath.Dir(path), 0755)
+// WithFormatters wraps the handler built by the HandlerBuilder with
+// a slog-formatter middleware applying the given formatters.
+func WithFormatters(formatters ...formatter.Formatter) optFun {
+	return func(cnf *config) {
+		cnf.formatters = append(cnf.formatters, formatters...)
+	}
 }
 
-func (h *handler) openLogFile() error {
-	path := h.cnf.currentFilePath()
+// MinFreeBytes sets the minimum free space that must be available on
+// the log volume. When free space falls below n the rotated files are
+// deleted, oldest first, and if that is not enough records are dropped
+// until space becomes available again.
+// Free space is checked at most once per second.
+// If n is 0 the check is disabled.
+func MinFreeBytes(n uint64) optFun {
+	return func(cnf *config) {
+		cnf.minFreeBytes = n
+	}
+}
 
-	// If the log file doesn't exist, create it, or append to the file
-	err := h.w.Open(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+// Framing sets how records are delimited in log files.
+func Framing(mode FramingMode) optFun {
+	return func(cnf *config) {
+		cnf.framing = mode
 	}
+}
 
-	return nil
+// LiveTail makes the handler publish every record written to the clients of
+// the http.Handler returned by TailHandler, turning it into a live log source
+// for dashboards. Each client has a buffer of [DEFAULT_TAIL_BUFFER] records:
+// clients too slow to keep up are disconnected, so that they never block
+// logging. Clients are disconnected by Close.
+func LiveTail(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.liveTail = enabled
+	}
 }
 
-// Enabled implements the method of the slog.Handler interface
-// by calling the same method of the formatter habdler.
-func (h handler) Enabled(ctx context.Context, level slog.Level) bool {
-	return h.formatter.Enabled(ctx, level)
+// EnsureTrailingNewline makes every record end with exactly one newline,
+// appending it to the records written by the formatter without one and
+// removing the extra newlines of the others, so that the records of resumed
+// files, counted by lines for WriteTrailer and LineNumbering, and the tools
+// reading log files line by line are reliable with any formatter.
+func EnsureTrailingNewline(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.trailingNewline = enabled
+	}
 }
 
-// Handle implements the method of the slog.Handler interface.
-func (h handler) Handle(ctx context.Context, r slog.Record) error {
-	if h.cnf.maxFileSize <= 0 {
-		return h.formatter.Handle(ctx, r)
+// SingleLineRecords guards the NDJSON invariant of one record per line at
+// the file layer, for formatters that may write raw newlines: newlines
+// within a record are replaced by the two characters `\n` and a newline is
+// appended to records not ending with one.
+func SingleLineRecords(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.singleLine = enabled
 	}
+}
 
-	h.mu.Lock()
-	defer h.mu.Unlock()
+// LineNumbering makes the handler precede every record with its line number
+// in the current log file, zero-padded to six digits and followed by "| ",
+// e.g. "000001| ". Numbering restarts in every new file and continues after
+// the records already in a resumed file. Line numbers ease human reading
+// and detecting truncations within a file. They count toward MaxFileSize.
+func LineNumbering(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.lineNumbering = enabled
+	}
+}
 
-	if h.w.Size() > int64(h.cnf.maxFileSize) {
-		err := h.w.Close()
-		if err != nil {
-			return err
-		}
-		rotatedFilePath := h.cnf.rotatedFilePath(time.Now())
-		err = os.Rename(h.cnf.currentFilePath(), rotatedFilePath)
-		if err != nil {
-			return err
-		}
+// SizeAccountingMode is the type of the constants used to select
+// which bytes count toward the MaxFileSize threshold.
+type SizeAccountingMode int
 
-		err = h.searchAndRemoveOldestFile()
-		if err != nil {
-			return err
-		}
+const (
+	// SizeAll counts all the bytes written to the file.
+	SizeAll SizeAccountingMode = iota
+	// SizePayloadOnly counts only the bytes of the formatted records,
+	// excluding the framing overhead and the trailer record.
+	SizePayloadOnly
+)
 
-		err = h.openLogFile()
-		if err != nil {
-			return err
-		}
+// SizeAccounting sets which bytes count toward the MaxFileSize threshold.
+// [SizePayloadOnly] keeps the content of each file under the threshold
+// regardless of the framing and trailer overhead, which is useful when
+// downstream systems cap the decoded payload rather than the file size.
+func SizeAccounting(mode SizeAccountingMode) optFun {
+	return func(cnf *config) {
+		cnf.sizeAccounting = mode
 	}
+}
 
-	return h.formatter.Handle(ctx, r)
+// DetectExternalRotation enables periodic checks, at most once per second,
+// that the current log file path still refers to the open file. When the
+// file has been renamed or removed by another process (e.g. logrotate)
+// the current log file is reopened.
+// On Windows open files usually cannot be renamed or removed by other
+// processes, so the check rarely has any effect.
+func DetectExternalRotation(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.detectExtRotation = enabled
+	}
 }
 
-func (h *handler) searchAndRemoveOldestFile() error {
-	entries, err := os.ReadDir(h.cnf.logDir)
-	if err != nil {
-		return err
+// TimeKey sets the key of the record time attribute
+// written by the formatter.
+func TimeKey(key string) optFun {
+	return func(cnf *config) {
+		cnf.timeKey = key
 	}
-	var n uint64
-	var oldestEntry fs.DirEntry
-	for _, entry := range entries {
-		if !strings.HasPrefix(entry.Name(), h.cnf.filePrefix) {
-			continue
-		}
-		n++
-		info, err := entry.Info()
-		if err != nil {
-			return err
-		}
+}
 
-		if oldestEntry == nil {
-			oldestEntry = entry
-			continue
-		}
+// TimeFormat sets the layout used to format the record time, to be used
+// in calls to [time.Time.Format]. The special values [TIME_FORMAT_UNIX]
+// and [TIME_FORMAT_UNIX_MILLI] format the time as an integer.
+func TimeFormat(layout string) optFun {
+	return func(cnf *config) {
+		cnf.timeFormat = layout
+	}
+}
 
-		oldestInfo, err := oldestEntry.Info()
-		if err != nil {
-			return err
-		}
+// WithLevelVar sets a [slog.LevelVar] holding the minimum enabled level,
+// overriding the Level of the handler options. The level can be changed
+// at runtime through v and is honored even by formatters ignoring the
+// handler options.
+func WithLevelVar(v *slog.LevelVar) optFun {
+	return func(cnf *config) {
+		cnf.levelVar = v
+	}
+}
 
-		if info.ModTime().Before(oldestInfo.ModTime()) {
-			oldestEntry = entry
-		}
+// LazyDerive makes WithAttrs and WithGroup record the attributes and groups
+// of derived handlers, applying them to the formatter only when the first
+// record is handled. This saves work and allocations for the many short-lived
+// derived loggers that are rarely used. In lazy mode Enabled is answered by
+// the formatter the attributes and groups are applied to.
+func LazyDerive(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.lazyDerive = enabled
 	}
+}
 
-	if n > h.cnf.maxRotatedFiles {
-		oldestFileName := h.cnf.filePath(oldestEntry.Name())
-		err = os.Remove(oldestFileName)
-		if err != nil {
-			return err
-		}
+// LazyFormatter defers building the formatter with the HandlerBuilder until
+// it is first needed, by Enabled, Handle, WithAttrs or WithGroup, saving its
+// cost for handlers that are created speculatively and seldom used.
+func LazyFormatter(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.lazyFormatter = enabled
 	}
-	return nil
 }
 
-func (h handler) clone() *handler {
-	return &handler{
-		formatter: h.formatter,
-		cnf:       h.cnf,
-		mu:        h.mu,
-		w:         h.w,
+// MinRotationInterval suppresses the size triggered rotations of the current
+// log file occurring less than d after the previous rotation, to protect the
+// file system from rotation storms when a small MaxFileSize meets bursts of
+// records. The tradeoff is that during bursts the current file, and later
+// the rotated file, can exceed MaxFileSize. Time based rotations are not
+// affected. If d is 0 rotations are not limited.
+func MinRotationInterval(d time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.minRotationGap = d
 	}
 }
 
-// WithAttrs implements the method of the slog.Handler interface by
-// cloning the current handler and calling the WithAttrs of the
-// formatter handler.
-func (h handler) WithAttrs(attr []slog.Attr) slog.Handler {
-	nh := h.clone()
-	nh.formatter = h.formatter.WithAttrs(attr)
-	return nh
+// RotateEvery makes the current log file rotate at the end of every time
+// bucket of the given granularity, with buckets aligned to the wall clock:
+// hourly buckets start at the top of the hour, 15 minute ones at :00, :15,
+// :30 and :45, and so on. Rotated files are named after the start of their
+// bucket. Buckets shorter than a day are aligned to local midnight, so that
+// granularities not dividing a day evenly make the last bucket of every day
+// shorter; longer ones are aligned to the zero time in UTC. The bucket of
+// an existing current file is computed from its modification time. Size
+// based rotation still applies within buckets.
+// If granularity is 0 no time based rotation is performed.
+func RotateEvery(granularity time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.rotateEvery = granularity
+	}
 }
 
-// WithGroup implements the method of the slog.Handler interface by
-// cloning the current handler and calling the WithGroup of the
-// formatter handler.
-func (h handler) WithGroup(name string) slog.Handler {
-	nh := h.clone()
+// SkipEmptyRotation makes RotateEvery skip the rotation of current
+// files with no records, so that buckets with no records leave no files.
+func SkipEmptyRotation(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.skipEmptyRotation = enabled
+	}
+}
+
+// WithEncryption enables the encryption of rotated files with AES-GCM, using
+// the key returned by keyProvider, which is called on every rotation and may
+// fetch the key from a key management service. The key must be 16, 24 or 32
+// bytes long to select AES-128, AES-192 or AES-256. Rotated files are read in
+// memory, encrypted to files named after them with [ENCRYPTED_FILE_EXTENSION]
+// appended, and removed. Encryption runs in the background once the new
+// current file is open, so rotation events report the plaintext path and
+// Close waits for it to finish. If it fails, the error is reported to OnError
+// and the meta logger and the rotated file is kept unencrypted. Encrypted
+// files start with a header holding the algorithm and the nonce, and can be
+// read back with [DecryptFile].
+// Files passed to WithRotatedSink are not encrypted, and encryption
+// disables LateWriteGrace.
+// If keyProvider is nil rotated files are not encrypted.
+func WithEncryption(keyProvider func() ([]byte, error)) optFun {
+	return func(cnf *config) {
+		cnf.encryptionKey = keyProvider
+	}
+}
+
+// RepairOnStart makes NewHandler repair the inconsistent states left in the
+// log directories by a crash during a rotation: stale temporary files of
+// metadata and encrypted files are removed, interrupted encryptions are
+// finished, or restarted if the rotated file was not removed yet, and the
+// sidecar files of a missing current file are removed before it is
+// recreated. The actions taken are logged to the meta logger.
+func RepairOnStart(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.repairOnStart = enabled
+	}
+}
+
+// ProbeWrite makes NewHandler write, sync and remove a small probe file in
+// the log directory before opening the current log file, failing with an
+// error wrapping ErrNotWritable if any step fails. It detects at startup
+// the mounts where opening files succeeds but writing them does not.
+func ProbeWrite(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.probeWrite = enabled
+	}
+}
+
+// LateWriteGrace keeps the file rotated at the end of a RotateEvery time
+// bucket open for the given window, during which records timestamped
+// within that bucket are appended to it rather than to the new current
+// file, so that records delayed on their way to the handler still land
+// in the file of their bucket. Only the last rotated file is kept open,
+// and a record is checked against its bucket with two time comparisons.
+// Late records are not counted in the trailer, metadata sidecar, index
+// and line numbers of the rotated file, nor announced by LiveTail.
+// While it is kept open, the file is not subject to MaxRotatedFiles,
+// MaxAge, MinFreeBytes and RetentionMode.
+// If window is 0 all records are written to the current file.
+func LateWriteGrace(window time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.lateWriteGrace = window
+	}
+}
+
+// bucketStart returns the start of the RotateEvery time bucket t belongs to.
+func (cnf *config) bucketStart(t time.Time) time.Time {
+	if cnf.rotateEvery >= 24*time.Hour {
+		return t.Truncate(cnf.rotateEvery)
+	}
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	return midnight.Add(t.Sub(midnight).Truncate(cnf.rotateEvery))
+}
+
+// StreamEnabled sets a predicate consulted by Enabled with the context of
+// every record, which turns the stream of records written by the handler
+// off at runtime for the contexts it returns false for, e.g. for tenants
+// whose logging was disabled, before any formatting work is done.
+func StreamEnabled(f func(ctx context.Context) bool) optFun {
+	return func(cnf *config) {
+		cnf.streamEnabled = f
+	}
+}
+
+// DailyFileIsCurrent makes the current file name date based:
+// <prefix><date><extension>, where date uses the [DEFAULT_DAILY_FILE_LAYOUT]
+// layout. Records are appended to the file of the current day, across
+// restarts too, and a new file is started at the date boundary without
+// renaming the previous one. Retention applies to the dated files.
+// The current file suffix is ignored.
+func DailyFileIsCurrent(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.dailyFileCurrent = enabled
+	}
+}
+
+// CurrentNameFunc makes the current file name time based, like
+// DailyFileIsCurrent does, but with the time dependent part returned by f:
+// <prefix><f(now)><extension>, where now is the WithClock time. Whenever the
+// name changes, e.g. at the end of a time bucket, a new file is started
+// without renaming the previous one, which already has its final name;
+// the switch is reported with the [RotateDaily] reason. Retention applies
+// to the files matching the prefix and extension. The returned names must
+// differ from the other file names of the handler. It takes precedence
+// over DailyFileIsCurrent, and the current file suffix is ignored.
+func CurrentNameFunc(f func(now time.Time) string) optFun {
+	return func(cnf *config) {
+		cnf.currentNameFunc = f
+	}
+}
+
+// CoalesceWindow enables buffering of formatted records, which are written
+// to file together at most d after the first of them was handled, or as soon
+// as [DEFAULT_COALESCE_BUFFER] bytes are buffered. This reduces the number of
+// write system calls under load, while bounding the latency of records.
+// Write errors are reported to the OnError function.
+// If d is 0 records are written as soon as they are handled.
+func CoalesceWindow(d time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.coalesceWindow = d
+	}
+}
+
+// ClosedWritePolicy is the type of the constants used to select
+// what happens to records handled after the handler has been closed.
+type ClosedWritePolicy int
+
+const (
+	// ClosedStderr writes the records to standard error.
+	ClosedStderr ClosedWritePolicy = iota
+	// ClosedDiscard silently drops the records.
+	ClosedDiscard
+	// ClosedError drops the records and makes Handle return [ErrClosed].
+	ClosedError
+)
+
+// OnClosedWrite sets what happens to records handled after Close,
+// e.g. by goroutines still logging during shutdown.
+func OnClosedWrite(policy ClosedWritePolicy) optFun {
+	return func(cnf *config) {
+		cnf.onClosedWrite = policy
+	}
+}
+
+// DuplicatePathPolicy is the type of the constants used to select what
+// happens when handlers of the same process write to the same current file.
+type DuplicatePathPolicy int
+
+const (
+	// DuplicateAllow allows the handlers, as they are independent, to
+	// write to the same files: their rotations and size accounting clash.
+	DuplicateAllow DuplicatePathPolicy = iota
+	// DuplicateError makes NewHandler and Reconfigure return [ErrPathInUse].
+	DuplicateError
+)
+
+// OnDuplicatePath sets what happens when the current log file of the handler,
+// or the date independent part of its name for DailyFileIsCurrent, is already
+// used by another open handler of the process. Handlers stop using their
+// files when closed.
+func OnDuplicatePath(policy DuplicatePathPolicy) optFun {
+	return func(cnf *config) {
+		cnf.onDuplicatePath = policy
+	}
+}
+
+// Handler is the type of the handlers returned by NewHandler.
+type Handler interface {
+	slog.Handler
+	// Close flushes and closes the current log file.
+	// Records handled afterwards are treated according to
+	// the OnClosedWrite policy. Close is idempotent.
+	// The handler returned by NewHandler owns the log files, which the
+	// handlers derived from it with WithAttrs and WithGroup share: Close
+	// does nothing on derived handlers, so that closing one of them cannot
+	// break the others, which stop writing when the owner is closed.
+	Close() error
+	// Reconfigure atomically replaces the handler configuration with
+	// one built from the default configuration and the given options,
+	// reopening the current log file if its path changed. Options
+	// affecting formatting (LogHandlerBuilder, WrapHandler,
+	// HandlerOptions, WithFormatters, Framing, TimeKey, TimeFormat,
+	// WithLevelVar, LazyDerive, LazyFormatter, LineNumbering,
+	// SingleLineRecords, EnsureTrailingNewline, OversizedRecordPolicy,
+	// LiveTail, LateWriteGrace, OverflowHandler, ExtraFormat,
+	// StreamEnabled, DeferredPersist) are fixed when the handler is
+	// created and are ignored.
+	// If the new configuration is not valid, or the new current
+	// log file cannot be opened, the configuration is left unchanged.
+	// The ExtraFormat sets of files are reconfigured afterwards in the
+	// same way, and their errors are returned joined.
+	Reconfigure(options ...optFun) error
+	// Events returns a channel receiving an event for every rotation of
+	// the current log file. The channel has a buffer of
+	// [DEFAULT_EVENTS_BUFFER] events: when it is full the oldest events
+	// are dropped, so that slow readers never block logging.
+	// The channel is closed by Close.
+	Events() <-chan RotationEvent
+	// Pause suppresses the rotation of the current log file, so that
+	// readers can safely snapshot it. Records are still written to it.
+	// Rotation resumes when Resume is called or, if MaxPause is set,
+	// when the maximum pause duration expires.
+	Pause()
+	// Resume ends a pause started by Pause, rotating the current
+	// log file immediately if it should have been rotated meanwhile.
+	Resume() error
+	// Stats returns the counters accumulated since the handler was created.
+	Stats() Stats
+	// StatsAndReset returns the counters accumulated since the previous
+	// call, or since the handler was created, and resets them to zero,
+	// for metrics exporters reporting per interval deltas. Resetting
+	// does not affect the cumulative counters returned by Stats.
+	StatsAndReset() Stats
+	// TailHandler returns an http.Handler streaming the records written
+	// from then on to its clients as Server-Sent Events, if LiveTail is
+	// enabled, or responding with 404 Not Found otherwise.
+	TailHandler() http.Handler
+	// HandleBatch handles the records in rs, in order, holding the handler
+	// lock once for the whole batch, for callers producing records in bulk.
+	// It bypasses the one record at a time path of slog.Logger: records
+	// not enabled at their level are skipped, and buffered data is flushed
+	// as for single records, when the buffer fills or the coalescing window
+	// ends. Rotation still applies between the records of the batch.
+	// The errors of the records are joined.
+	HandleBatch(ctx context.Context, rs []slog.Record) error
+	// Rotate rotates the current log file immediately, unless rotation
+	// is paused.
+	Rotate() error
+	// Flush writes the buffered records to the current log file.
+	Flush() error
+	// Reopen closes and reopens the current log file, e.g. after it was
+	// moved by an external tool.
+	Reopen() error
+	// Healthy returns nil if the handler is working, or otherwise the reason
+	// it is not: ErrDegraded while it logs to standard error, ErrClosed
+	// after Close, or the error of the latest record, e.g. ErrLowFreeSpace
+	// or a write error, until a record is handled successfully. It takes
+	// no lock, so it is cheap enough for frequent readiness probes.
+	Healthy() error
+	// CurrentFileAge returns the time elapsed, according to the WithClock
+	// clock, since the current log file was opened, or 0 if no log file was
+	// opened yet. Like Healthy it takes no lock, so monitors can poll it to
+	// detect a handler stuck on a file it should have rotated.
+	CurrentFileAge() time.Duration
+	// Persist ends the deferral started by DeferredPersist: it opens the
+	// current log file and writes to it the records buffered in memory,
+	// rotating as usual, then writes the following records directly.
+	// Without DeferredPersist, or once persisted, it does nothing.
+	Persist() error
+}
+
+// WriteIndex enables writing an index file, named after the log file with the
+// [INDEX_FILE_EXTENSION] extension appended, which allows seeking quickly into
+// large log files. Whenever a record is the first written after an interval
+// bytes boundary, an entry with its byte offset and timestamp is appended to
+// the index. Entries are 16 bytes long: the offset followed by the timestamp
+// in nanoseconds since the epoch, both as big-endian integers.
+// Index files are renamed and removed together with their log file.
+// If interval is 0 no index is written.
+func WriteIndex(interval uint64) optFun {
+	return func(cnf *config) {
+		cnf.indexInterval = interval
+	}
+}
+
+// StrictFileMode makes created log files, along with their index, metadata,
+// encrypted, bundle and pointer files, and the log directory get exactly the
+// [DEFAULT_FILE_MODE] and [DEFAULT_DIR_MODE] permissions, by calling chmod
+// after their creation, as the permissions passed to the system calls are
+// masked by the process umask. It has no effect on Windows.
+func StrictFileMode(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.strictFileMode = enabled
+	}
+}
+
+// MetaLogger sets a logger receiving the handler lifecycle events:
+// rotations, removals of rotated files and errors.
+// The logger must not write through the handler itself.
+func MetaLogger(logger *slog.Logger) optFun {
+	return func(cnf *config) {
+		cnf.metaLogger = logger
+	}
+}
+
+// SyslogMeta sends the handler lifecycle events to the system logger
+// through log/syslog, as the MetaLogger option does. It is not supported
+// on Windows and Plan 9, where NewHandler fails if it is enabled.
+func SyslogMeta(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.syslogMeta = enabled
+	}
+}
+
+// WatchLogDir enables caching the list of rotated files, so that retention
+// does not read the log directory on every rotation. The cache is updated
+// with the files renamed and removed by the handler; on Linux changes made
+// by other processes are tracked through inotify, while on other platforms
+// the directory is read again every [DEFAULT_RESCAN_INTERVAL].
+// The watcher is stopped by Close.
+func WatchLogDir(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.watchLogDir = enabled
+	}
+}
+
+// SequenceKey enables adding to every record an attribute with the given key
+// and a sequence number, starting from 1, which is shared by the handler and
+// the handlers derived from it with WithAttrs and WithGroup. The number is
+// assigned before a record can be dropped, so that consumers can detect lost
+// records by gaps in the sequence. Like the other record attributes, it is
+// nested in the groups opened with WithGroup.
+// If key is empty no attribute is added.
+func SequenceKey(key string) optFun {
+	return func(cnf *config) {
+		cnf.sequenceKey = key
+	}
+}
+
+// ResetSequenceOnNewFile makes the sequence numbers enabled by SequenceKey
+// restart from 1 in every new log file.
+func ResetSequenceOnNewFile(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.resetSequence = enabled
+	}
+}
+
+// TotalKey enables adding to every record an attribute with the given key
+// and the number of records handled so far, including the record itself, by
+// all the handlers of the process enabling it. Unlike the sequence numbers
+// enabled by SequenceKey, the count is never reset. The attribute follows
+// the sequence number attribute, if any.
+// If key is empty no attribute is added.
+func TotalKey(key string) optFun {
+	return func(cnf *config) {
+		cnf.totalKey = key
+	}
+}
+
+// AddSource enables adding to every record with a program counter an
+// attribute with the [slog.SourceKey] key and the "file:line" location of
+// the logging call, resolved by the handler itself, so that the location
+// is logged even by formatters ignoring [slog.HandlerOptions.AddSource].
+// Resolving the location costs a runtime.CallersFrames lookup per record.
+// The attribute follows the TotalKey attribute, if any.
+func AddSource(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.addSource = enabled
+	}
+}
+
+// MaxFilesPerDir sets the maximum number of rotated files kept in a single
+// directory. Once the log directory holds n rotated files, new rotated files
+// are placed in the sibling directory <logDir>.1, then in <logDir>.2 and so on,
+// always using the first directory with room for them. Retention applies to
+// the rotated files of all these directories, while the current file always
+// stays in the log directory.
+// If n is 0 the number of files per directory is not limited.
+func MaxFilesPerDir(n int) optFun {
+	return func(cnf *config) {
+		cnf.maxFilesPerDir = n
+	}
+}
+
+// WithRotatedSink makes rotations copy the content of the current log file
+// to the writer returned by sink, called with the rotated file name, and
+// remove the file, instead of renaming it. The writer is closed after the
+// copy. It is meant for tests capturing the rotated files in memory: since
+// no rotated file is kept on disk, retention options have no effect on them.
+func WithRotatedSink(sink func(name string) io.WriteCloser) optFun {
+	return func(cnf *config) {
+		cnf.rotatedSink = sink
+	}
+}
+
+// WriteMetadata makes the handler write, next to every rotated file, a sidecar
+// file named after it with the [METADATA_FILE_EXTENSION] extension appended.
+// It holds a JSON object describing the file, with the times of its first
+// and last records, its record count and size, the host name and process id
+// of the writer and the schema version. The sidecar is written atomically
+// after the rotation and is removed together with its log file.
+func WriteMetadata(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.writeMetadata = enabled
+	}
+}
+
+// WriteTrailer makes the handler write a trailer record at the end of every
+// log file, before it is rotated, reporting the number of records the file
+// contains and its size in bytes, both excluding the trailer itself. This
+// allows consumers to detect truncated files. When the handler resumes
+// writing to an existing file, the records already in it are counted,
+// except for the header, trailer, carry-over and summary records written
+// by the handler itself, recognized by their message, and for a partial
+// last record left by a crash.
+func WriteTrailer(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.writeTrailer = enabled
+	}
+}
+
+// ChainHeaders makes the handler start every log file created by a rotation
+// with a header record, with the "rotoslog header" message, linking it to
+// the file rotated before it: the header holds the name of that file as
+// prev, or an empty prev if it vanished before the rotation, the time of
+// the rotation as rotatedAt, and the reason of the rotation. Following the
+// links, consumers can verify that a chain of files is unbroken. Headers
+// are not counted as records by WriteTrailer.
+func ChainHeaders(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.chainHeaders = enabled
+	}
+}
+
+// CarryOverBytes makes the handler start every log file created by a
+// rotation with a carry-over record, with the "rotoslog carry-over" message,
+// holding as data the last n bytes of the file rotated before it, which can
+// start in the middle of a record, and the name of that file as prev. It
+// gives stateful consumers of a single file the context that precedes it.
+// The carry-over record follows the chain header, if any. It is not
+// counted as a record by WriteTrailer nor, with SizePayloadOnly accounting,
+// toward MaxFileSize. If n is 0 nothing is carried over.
+func CarryOverBytes(n int) optFun {
+	return func(cnf *config) {
+		cnf.carryOverBytes = n
+	}
+}
+
+// SyncAbove makes the handler flush the buffered data and sync the current log
+// file to stable storage right after writing a record with level at least
+// level, so that the last records logged before a crash survive it, even if
+// the process exits immediately after.
+func SyncAbove(level slog.Level) optFun {
+	return func(cnf *config) {
+		cnf.syncAbove = &level
+	}
+}
+
+// SyncMode is the type of the constants used to select
+// how log files are synchronized to stable storage.
+type SyncMode int
+
+const (
+	// SyncNone leaves synchronization to the operating system.
+	SyncNone SyncMode = iota
+	// SyncData makes every write wait until the written data, and the
+	// metadata needed to retrieve it, reach stable storage (O_DSYNC).
+	SyncData
+	// SyncFull makes every write wait until the written data
+	// and all the file metadata reach stable storage (O_SYNC).
+	SyncFull
+)
+
+// OpenSyncMode sets the synchronous mode used to open log files, so that
+// records reach stable storage before Handle returns. Where the open flag
+// is not available (O_DSYNC outside Linux), Sync is called after every
+// write instead. Either way, synchronous writes reduce throughput by
+// orders of magnitude and should be reserved to logs needing
+// write-through durability, like audit logs.
+func OpenSyncMode(mode SyncMode) optFun {
+	return func(cnf *config) {
+		cnf.syncMode = mode
+	}
+}
+
+// NameFromFirstRecord makes the <timestamp> of a rotated file the time of
+// the first record written to it, instead of the rotation time, so that
+// file names reflect the time range of their content. When the handler
+// resumes writing to an existing file, whose first record time is unknown,
+// the rotation time is used.
+func NameFromFirstRecord(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.nameFromFirst = enabled
+	}
+}
+
+// RotationInfo describes the current log file being rotated.
+type RotationInfo struct {
+	// Time is the rotation time, according to the WithClock clock.
+	Time time.Time
+	// FirstRecord is the time of the first record written to the file.
+	// It is zero for files the handler resumed writing to.
+	FirstRecord time.Time
+	// LastRecord is the time of the last record written to the file
+	// by the handler. It is zero if no record was written.
+	LastRecord time.Time
+	// Bytes is the size of the file.
+	Bytes int64
+	// Records is the number of records in the file,
+	// excluding the WriteTrailer trailer.
+	Records uint64
+}
+
+// RotatedNameFunc sets a function returning the name of each rotated file,
+// given the statistics of the file being rotated, overriding DateTimeLayout
+// and NameFromFirstRecord. The names must start with the file prefix and
+// be unique, otherwise rotated files are not found by retention or are
+// overwritten. MaxAge retention relies on the modification time of files
+// whose names do not follow DateTimeLayout.
+func RotatedNameFunc(f func(info RotationInfo) string) optFun {
+	return func(cnf *config) {
+		cnf.rotatedNameFunc = f
+	}
+}
+
+// HardLinkLatest makes the handler maintain, in the log directory, a hard
+// link with the given name to the current file, updated every time a new
+// current file is opened. It serves tools that do not follow symbolic links.
+// Hard links only work within a single file system; on Windows the option
+// is ignored.
+func HardLinkLatest(name string) optFun {
+	return func(cnf *config) {
+		cnf.hardLinkLatest = name
+	}
+}
+
+// CurrentPointerFile makes the handler maintain, in the log directory, a text
+// file with the given name holding a single line with the name of the current
+// file, rewritten every time a new current file is opened. It lets portable
+// tools find the current file without symbolic or hard links. The file is
+// replaced atomically, so readers never see a partial name.
+func CurrentPointerFile(name string) optFun {
+	return func(cnf *config) {
+		cnf.currentPointer = name
+	}
+}
+
+// DeleteAfter makes retention mark the rotated files to be deleted, renaming
+// them with the [DELETED_FILE_EXTENSION] extension appended, and delete them
+// in the background only d after being marked. This spreads the deletion I/O
+// and gives readers a grace period to finish with the files. Marked files
+// no longer count as rotated files. Files marked by a previous run are
+// deleted when the handler is created, if their grace period has expired,
+// or scheduled for deletion otherwise. The MinFreeBytes free space guard
+// deletes files immediately.
+// If d is 0 files are deleted immediately.
+func DeleteAfter(d time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.deleteAfter = d
+	}
+}
+
+// ConfineToLogDir makes NewHandler and Reconfigure reject the configurations
+// where the file prefix, current file suffix, extension, timestamp layout or
+// HardLinkLatest name would make the handler create files outside the log
+// directory, e.g. through path separators or "..", and the ones setting
+// MaxFilesPerDir, whose spill directories are siblings of the log directory.
+// It protects hosts that take these settings from untrusted tenants against
+// path traversal. It does not protect against symbolic links created in the
+// log directory.
+func ConfineToLogDir(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.confine = enabled
+	}
+}
+
+// WithClock sets the function returning the current time used for rotation
+// decisions and file names: the daily file switch, the rotated file
+// timestamps, the MaxAge and MaxPause expiries and the spacing of the
+// DetectExternalRotation checks. Records keep the time set by slog, so
+// tests can advance the clock to force time based rotations without
+// affecting record timestamps.
+func WithClock(now func() time.Time) optFun {
+	return func(cnf *config) {
+		cnf.clock = now
+	}
+}
+
+// MaxPause sets the maximum time rotation stays suppressed by Pause, guarding
+// against the unbounded growth of the current file if Resume is never called.
+// If d is 0 pauses last until Resume is called.
+func MaxPause(d time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.maxPause = d
+	}
+}
+
+// FallbackToStderr makes NewHandler succeed even if the log directory or the
+// current log file cannot be created, for example because a volume is not
+// mounted. Records are then formatted to standard error, without rotation,
+// and opening the log file is retried at most once per second: when it
+// succeeds the handler switches to it.
+func FallbackToStderr(enabled bool) optFun {
+	return func(cnf *config) {
+		cnf.fallbackToStderr = enabled
+	}
+}
+
+// MaxPendingTasks sets the maximum number of background tasks, namely the
+// deletions deferred by DeleteAfter, that can be pending at the same time.
+// When the limit is reached rotated files are deleted immediately instead,
+// bounding the memory used under rotation storms. The number of pending
+// tasks is reported by Stats. If n is 0 there is no limit.
+func MaxPendingTasks(n int) optFun {
+	return func(cnf *config) {
+		cnf.maxPendingTasks = n
+	}
+}
+
+// RetentionPolicy is the type of the constants used to select what
+// happens to the rotated files exceeding the retention limits.
+type RetentionPolicy int
+
+const (
+	// RetentionDelete deletes the files.
+	RetentionDelete RetentionPolicy = iota
+	// RetentionTruncate truncates the files and recycles them as current files.
+	RetentionTruncate
+)
+
+// RetentionMode sets what happens to the rotated files exceeding the
+// MaxRotatedFiles and MaxAge limits. With [RetentionTruncate] such a file
+// is truncated to zero length and renamed to the spare file
+// <prefix>spare<extension> in the log directory, which is then renamed to
+// become the next current log file, preserving its inode and avoiding the
+// creation of a new file. Until it is recycled, the spare file occupies a
+// directory entry, and disk blocks on filesystems preallocating them, but
+// does not count as a rotated file. Only one spare file is kept: other
+// files exceeding the limits are deleted, honoring DeleteAfter. The
+// MinFreeBytes free space guard always deletes files.
+func RetentionMode(mode RetentionPolicy) optFun {
+	return func(cnf *config) {
+		cnf.retentionMode = mode
+	}
+}
+
+// Heartbeat makes the handler write a record with the given level and message
+// every interval, from a background goroutine stopped by Close. In low traffic
+// services this keeps the current file alive, so that time based files are
+// created and rotated on schedule, and tells a quiet service apart from a
+// broken one. Heartbeat records are formatted without the attributes and
+// groups of derived handlers and bypass the level filtering.
+// If interval is 0 no heartbeat is written.
+func Heartbeat(interval time.Duration, level slog.Level, msg string) optFun {
+	return func(cnf *config) {
+		cnf.heartbeatInterval = interval
+		cnf.heartbeatLevel = level
+		cnf.heartbeatMsg = msg
+	}
+}
+
+// NoLock disables the locking performed on every Handle call, saving its
+// cost in single goroutine programs. The handler, and the handlers derived
+// from it, are then unsafe for concurrent use, so NoLock must not be used
+// with options starting background goroutines, such as CoalesceWindow,
+// Heartbeat, SummaryInterval and SyncInterval.
+func NoLock() optFun {
+	return func(cnf *config) {
+		cnf.noLock = true
+	}
+}
+
+// newTicker returns the channel of a ticker ticking every d and the
+// function stopping it. The background goroutines get their ticker
+// from the configuration, so that tests can tick them at will.
+func newTicker(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+// nopLocker is a no-op sync.Locker.
+type nopLocker struct{}
+
+func (nopLocker) Lock()   {}
+func (nopLocker) Unlock() {}
+
+// handler implements Handler. Its formatter, and the ones derived from it
+// by WithAttrs and WithGroup, write to w, or to buf when records are captured.
+// Both stay the same objects for the whole life of the handler: rotations,
+// reopens and Reconfigure replace the file w wraps in place, so the
+// formatters never need to be rebuilt and keep their attributes and groups.
+type handler struct {
+	w         *logFile
+	buf       *bytes.Buffer
+	formatter slog.Handler
+	cnf       *config
+	mu        sync.Locker
+	st        *state
+	levelVar  *slog.LevelVar
+	lazy      bool
+	derived   *derivation
+	overflow  slog.Handler
+	extras    []slog.Handler
+	enabled   func(ctx context.Context) bool
+	owner     bool
+}
+
+// totalRecords counts the records handled by the handlers enabling TotalKey.
+var totalRecords atomic.Uint64
+
+// state holds the mutable state shared by a handler and its clones.
+// It is guarded by the handler mutex.
+type state struct {
+	lastSpaceCheck    time.Time
+	lowSpace          bool
+	lastRotationCheck time.Time
+	lastOpenAttempt   time.Time
+	degraded          bool
+	health            atomic.Pointer[error]
+	opened            atomic.Pointer[fileOpening]
+	flushPending      bool
+	closed            bool
+	dirCache          *dirCache
+	sequence          uint64
+	formatter         slog.Handler
+	fileRecords       uint64
+	firstRecordTime   time.Time
+	lastRecordTime    time.Time
+	resumedFile       bool
+	payloadSize       int64
+	bucketStart       time.Time
+	lastRotation      time.Time
+	lastCleanup       time.Time
+	pendingCleanups   int
+	bundledPeriod     time.Time
+	late              *os.File
+	lateBucket        time.Time
+	lateUntil         time.Time
+	stats             Stats
+	intervalStats     Stats
+	pausedAt          time.Time
+	deletions         map[string]*time.Timer
+	buckets           map[string]*tokenBucket
+	dropped           map[string]uint64
+	carryOver         []byte
+	extras            []Handler
+	generation        uint64
+	unsynced          bool
+	lastSync          time.Time
+	events            chan RotationEvent
+	stop              chan struct{}
+	tail              *broadcaster
+	syslog            io.Closer
+	background        background
+	deferred          *deferredRecords
+	registryKey       string
+}
+
+// NewHandler creates a new handler with the given options.
+func NewHandler(options ...optFun) (Handler, error) {
+	cnf := defaultConfig
+	h := handler{
+		owner: true,
+		cnf:   &cnf,
+		mu:    &sync.Mutex{},
+		w:     &logFile{},
+		st: &state{
+			deletions: map[string]*time.Timer{},
+			buckets:   map[string]*tokenBucket{},
+			events:    make(chan RotationEvent, DEFAULT_EVENTS_BUFFER),
+			stop:      make(chan struct{}),
+		},
+	}
+	for _, opt := range options {
+		opt(h.cnf)
+	}
+	if h.cnf.noLock {
+		h.mu = nopLocker{}
+	}
+	err := h.applyGeneration(h.cnf)
+	if err != nil {
+		return nil, err
+	}
+	err = h.cnf.validate()
+	if err != nil {
+		return nil, err
+	}
+	h.levelVar = h.cnf.levelVar
+	h.lazy = h.cnf.lazyDerive
+	h.overflow = h.cnf.overflow
+	h.enabled = h.cnf.streamEnabled
+	if h.cnf.liveTail {
+		h.st.tail = newBroadcaster()
+	}
+	h.cnf.configureLogFile(h.w)
+	if h.cnf.syslogMeta {
+		h.cnf.metaLogger, h.st.syslog, err = newSyslogLogger()
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := register(h.cnf)
+	if err != nil {
+		h.closeSyslog()
+		return nil, err
+	}
+	h.st.registryKey = key
+	h.st.lastCleanup = h.cnf.clock()
+	if h.cnf.deferredPersist > 0 {
+		h.st.deferred = &deferredRecords{}
+	} else {
+		err = h.openFiles()
+	}
+	if err != nil {
+		if !h.cnf.fallbackToStderr {
+			unregister(key)
+			h.closeSyslog()
+			return nil, err
+		}
+		h.fallBack(err)
+	}
+	if h.cnf.watchLogDir {
+		h.st.dirCache = newDirCache(h.cnf.logDir)
+	}
+	if h.cnf.rotateEvery > 0 {
+		h.st.bucketStart = h.cnf.bucketStart(h.cnf.clock())
+		if h.w.Size() > 0 {
+			info, err := h.w.Stat()
+			if err == nil {
+				h.st.bucketStart = h.cnf.bucketStart(info.ModTime())
+			}
+		}
+	}
+	if h.cnf.deleteAfter > 0 && !h.st.degraded && h.st.deferred == nil {
+		err = h.scheduleMarkedFiles()
+		if err != nil {
+			h.Close()
+			return nil, fmt.Errorf("%w: %w", ErrCleanup, err)
+		}
+	}
+	var out io.Writer = h.w
+	if h.cnf.capturesRecords() {
+		h.buf = &bytes.Buffer{}
+		out = h.buf
+	}
+	if h.cnf.lazyFormatter {
+		cnf := h.cnf
+		h.formatter = &lazyFormatter{build: func() slog.Handler { return cnf.newFormatter(out) }}
+	} else {
+		h.formatter = h.cnf.newFormatter(out)
+	}
+	h.st.formatter = h.formatter
+	if h.cnf.logConfigOnStart {
+		err = h.logConfig()
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	if h.cnf.heartbeatInterval > 0 {
+		go h.heartbeat(h.cnf.heartbeatInterval, h.cnf.heartbeatLevel, h.cnf.heartbeatMsg)
+	}
+	if h.cnf.syncInterval > 0 {
+		go h.syncPeriodically(h.cnf.syncInterval)
+	}
+	if len(h.cnf.extraFormats) > 0 {
+		err = h.openExtraFormats()
+		if err != nil {
+			h.Close()
+			return nil, err
+		}
+		h.extras = make([]slog.Handler, len(h.st.extras))
+		for i, x := range h.st.extras {
+			h.extras[i] = x
+		}
+	}
+	if h.cnf.summaryInterval > 0 {
+		h.st.dropped = map[string]uint64{}
+		go h.summarize(h.cnf.summaryInterval)
+	}
+	h.updateHealth(nil)
+	return h, nil
+}
+
+// heartbeat writes a heartbeat record every interval until the handler
+// is closed. It must be called on the root handler.
+func (h handler) heartbeat(interval time.Duration, level slog.Level, msg string) {
+	ticks, stop := h.cnf.newTicker(interval)
+	defer stop()
+	for {
+		select {
+		case <-h.st.stop:
+			return
+		case <-ticks:
+		}
+		h.mu.Lock()
+		if !h.st.closed {
+			r := slog.NewRecord(time.Now(), level, msg, 0)
+			err := h.handle(context.Background(), r)
+			if err != nil {
+				h.reportError(err)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// logConfig writes a record summarizing the rotation settings.
+// The record level is the minimum enabled level, so that it is never dropped.
+func (h handler) logConfig() error {
+	r := slog.NewRecord(time.Now(), h.cnf.level(), "rotoslog configuration", 0)
+	r.AddAttrs(
+		slog.String("logDir", h.cnf.logDir),
+		slog.Uint64("maxFileSize", h.cnf.maxFileSize),
+		slog.Uint64("maxRotatedFiles", h.cnf.maxRotatedFiles),
+		slog.String("dateTimeLayout", h.cnf.dateTimeLayout),
+		slog.String("format", fmt.Sprintf("%T", unwrapFormatter(h.formatter))),
+	)
+	return h.Handle(context.Background(), r)
+}
+
+func (h *handler) mkLogDir() error {
+	dir := filepath.Dir(h.cnf.currentFilePath())
+	_, err := os.Stat(dir)
+	created := errors.Is(err, fs.ErrNotExist)
+	err = os.MkdirAll(dir, DEFAULT_DIR_MODE)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDirCreate, err)
+	}
+	if created && h.cnf.strictFileMode && runtime.GOOS != "windows" {
+		err = os.Chmod(dir, DEFAULT_DIR_MODE)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrDirCreate, err)
+		}
+	}
+	return nil
+}
+
+// probeLogDir writes, syncs and removes a probe file
+// in the directory of the current log file.
+func (cnf *config) probeLogDir() error {
+	dir := filepath.Dir(cnf.currentFilePath())
+	f, err := os.CreateTemp(dir, PROBE_FILE_PATTERN)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrNotWritable, dir, err)
+	}
+	_, err = f.Write([]byte("probe\n"))
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	rerr := os.Remove(f.Name())
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrNotWritable, dir, err)
+	}
+	return nil
+}
+
+// openFiles prepares the log directories and opens the current log file.
+func (h *handler) openFiles() error {
+	err := h.mkLogDir()
+	if err == nil && h.cnf.ringFiles {
+		err = h.cnf.prepareRing()
+	}
+	if err == nil && h.cnf.probeWrite {
+		err = h.cnf.probeLogDir()
+	}
+	if err == nil && h.cnf.repairOnStart {
+		err = h.repairLogDirs()
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrCleanup, err)
+		}
+	}
+	if err == nil {
+		err = h.openLogFile()
+	}
+	return err
+}
+
+// openLogFile opens the current log file, creating the log
+// directory first in case it was removed since the last open.
+// If an error occurs once the file is open, the file is closed.
+func (h *handler) openLogFile() (err error) {
+	path := h.cnf.currentFilePath()
+	err = h.mkLogDir()
+	if err != nil {
+		return err
+	}
+
+	if h.cnf.retentionMode == RetentionTruncate {
+		err = h.recycleSpareFile(path)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrOpen, err)
+		}
+	}
+
+	// If the log file doesn't exist, create it, or append to the file
+	syncFlag, _ := openSyncFlag(h.cnf.syncMode)
+	err = h.w.Open(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY|syncFlag, DEFAULT_FILE_MODE)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrOpen, err)
+	}
+	defer func() {
+		if err != nil {
+			h.w.Close()
+		}
+	}()
+
+	if h.cnf.hardLinkLatest != "" && runtime.GOOS != "windows" {
+		err = h.linkLatest(path)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrLink, err)
+		}
+	}
+	if h.cnf.currentPointer != "" {
+		err = h.writeCurrentPointer(path)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrLink, err)
+		}
+	}
+
+	h.st.opened.Store(&fileOpening{at: h.cnf.clock(), clock: h.cnf.clock})
+	h.st.firstRecordTime = time.Time{}
+	h.st.lastRecordTime = time.Time{}
+	h.st.resumedFile = h.w.Size() > 0
+	h.st.fileRecords = 0
+	h.st.payloadSize = h.w.Size()
+	if h.cnf.countsRecords() && h.w.Size() > 0 {
+		n, own, err := countRecords(path, h.cnf.framing)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrOpen, err)
+		}
+		h.st.fileRecords = n - own
+	}
+	if h.cnf.sizeAccounting == SizePayloadOnly && h.cnf.framingOverhead() > 0 && h.w.Size() > 0 {
+		n, _, err := countRecords(path, h.cnf.framing)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrOpen, err)
+		}
+		h.st.payloadSize -= int64(n) * h.cnf.framingOverhead()
+	}
+	return nil
+}
+
+// fileSize returns the size of the current log file
+// counted according to the SizeAccounting mode.
+func (h handler) fileSize() int64 {
+	if h.cnf.sizeAccounting == SizePayloadOnly {
+		return h.st.payloadSize
+	}
+	return h.w.Size()
+}
+
+// Close implements the method of the Handler interface.
+func (h handler) Close() error {
+	if !h.owner {
+		return nil
+	}
+	h.mu.Lock()
+	if h.st.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.st.closed = true
+	// Let the background jobs, which take the lock, finish first.
+	h.mu.Unlock()
+	h.waitBackground()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	defer h.closeSyslog()
+	h.updateHealth(nil)
+	if h.cnf.onClosedWrite == ClosedStderr {
+		h.w.SetFallback(os.Stderr)
+	}
+	var err error
+	if h.st.dropped != nil {
+		err = h.writeSummary()
+	}
+	retire := h.cnf.perProcessCurrent && !h.cnf.timeNamedCurrent() && !h.st.degraded && h.st.deferred == nil
+	if retire {
+		rerr := h.retireCurrentFile()
+		if err == nil {
+			err = rerr
+		}
+	}
+	if h.st.pendingCleanups > 0 {
+		cerr := h.runCleanup()
+		if err == nil {
+			err = cerr
+		}
+	}
+	if h.st.dirCache != nil {
+		h.st.dirCache.close()
+		h.st.dirCache = nil
+	}
+	for path, timer := range h.st.deletions {
+		timer.Stop()
+		delete(h.st.deletions, path)
+	}
+	close(h.st.events)
+	close(h.st.stop)
+	unregister(h.st.registryKey)
+	if h.st.tail != nil {
+		h.st.tail.close()
+	}
+	h.closeLate()
+	if h.st.extras != nil {
+		xerr := h.closeExtraFormats()
+		if err == nil {
+			err = xerr
+		}
+	}
+	if h.st.deferred != nil {
+		// The records were never persisted: discard them.
+		h.st.deferred = nil
+		return err
+	}
+	if h.st.degraded || retire {
+		return err
+	}
+	if h.cnf.syncInterval > 0 && h.st.unsynced {
+		serr := h.syncFile()
+		if err == nil {
+			err = serr
+		}
+	}
+	cerr := h.w.Close()
+	if cerr != nil {
+		return fmt.Errorf("%w: %w", ErrClose, cerr)
+	}
+	return err
+}
+
+// retireCurrentFile rotates the current log file of the process, if it is
+// not empty, and removes it on Close, as no other process would rotate it.
+func (h handler) retireCurrentFile() error {
+	var err error
+	if h.w.Size() > 0 {
+		err = h.rotate(RotateSize)
+	}
+	cerr := h.w.Close()
+	if err != nil {
+		return err
+	}
+	if cerr != nil {
+		return fmt.Errorf("%w: %w", ErrClose, cerr)
+	}
+	path := h.cnf.currentFilePath()
+	err = os.Remove(path)
+	if err == nil {
+		err = removeSidecars(path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCleanup, err)
+	}
+	return nil
+}
+
+// fallBack switches logging to standard error after
+// the log file could not be opened because of err.
+func (h handler) fallBack(err error) {
+	h.w.SetFallback(os.Stderr)
+	h.st.degraded = true
+	h.st.lastOpenAttempt = h.cnf.clock()
+	h.meta(slog.LevelWarn, "logging to standard error", "error", err)
+}
+
+// retryOpen tries to open the log file while logging to standard error,
+// at most once every fallbackRetryInterval. Once the file is open, the
+// files marked for deletion by DeleteAfter are scheduled as on creation.
+func (h handler) retryOpen() {
+	now := h.cnf.clock()
+	if now.Sub(h.st.lastOpenAttempt) < fallbackRetryInterval {
+		return
+	}
+	h.st.lastOpenAttempt = now
+	err := h.mkLogDir()
+	if err == nil {
+		err = h.openLogFile()
+	}
+	if err != nil {
+		return
+	}
+	h.st.degraded = false
+	h.w.SetFallback(nil)
+	h.meta(slog.LevelInfo, "logging to file", "path", h.w.Path())
+	if h.cnf.deleteAfter > 0 {
+		err = h.scheduleMarkedFiles()
+		if err != nil {
+			h.reportError(fmt.Errorf("%w: %w", ErrCleanup, err))
+		}
+	}
+}
+
+// linkLatest atomically replaces the latest hard link with
+// a link to the file at path.
+func (h *handler) linkLatest(path string) error {
+	linkPath := h.cnf.filePath(h.cnf.hardLinkLatest)
+	tmpPath := linkPath + ".tmp"
+	err := os.Remove(tmpPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = os.Link(path, tmpPath)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, linkPath)
+}
+
+// writeCurrentPointer replaces the CurrentPointerFile
+// with one naming the current file at path.
+func (h *handler) writeCurrentPointer(path string) error {
+	pointerPath := h.cnf.filePath(h.cnf.currentPointer)
+	tmpPath := pointerPath + ".tmp"
+	err := writeFile(tmpPath, []byte(filepath.Base(path)+"\n"), DEFAULT_FILE_MODE, h.cnf.strictFileMode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, pointerPath)
+}
+
+// Reconfigure implements the method of the Handler interface.
+func (h handler) Reconfigure(options ...optFun) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.st.closed {
+		return ErrClosed
+	}
+
+	cnf := defaultConfig
+	for _, opt := range options {
+		opt(&cnf)
+	}
+	cnf.keepFormatting(h.cnf)
+	err := h.applyGeneration(&cnf)
+	if err != nil {
+		return err
+	}
+	err = cnf.validate()
+	if err != nil {
+		return err
+	}
+	if cnf.ringFiles {
+		err = cnf.loadRingSlot()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrOpen, err)
+		}
+	}
+	var syslog io.Closer
+	if cnf.syslogMeta {
+		if h.st.syslog != nil {
+			// Keep the connection to the system logger.
+			cnf.metaLogger = h.cnf.metaLogger
+		} else {
+			cnf.metaLogger, syslog, err = newSyslogLogger()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = h.reregister(cnf)
+	if err != nil {
+		if syslog != nil {
+			syslog.Close()
+		}
+		return err
+	}
+	if syslog != nil {
+		h.st.syslog = syslog
+	} else if !cnf.syslogMeta {
+		h.closeSyslog()
+	}
+	if h.st.extras != nil {
+		return h.reconfigureExtraFormats()
+	}
+	return nil
+}
+
+// reregister moves the handler registration to the paths
+// of cnf, if they changed, and reconfigures the handler.
+func (h handler) reregister(cnf config) error {
+	key, err := cnf.registryKey()
+	if err != nil {
+		return err
+	}
+	if key == h.st.registryKey {
+		return h.reconfigure(cnf)
+	}
+	key, err = register(&cnf)
+	if err != nil {
+		return err
+	}
+	err = h.reconfigure(cnf)
+	if err != nil {
+		unregister(key)
+		return err
+	}
+	unregister(h.st.registryKey)
+	h.st.registryKey = key
+	return nil
+}
+
+// reconfigure replaces the handler configuration with cnf,
+// opening the new current log file if needed.
+func (h handler) reconfigure(cnf config) (err error) {
+	// While records are deferred no file is open: Persist
+	// opens the current log file of the new configuration.
+	if h.st.deferred == nil && (cnf.currentFilePath() != h.cnf.currentFilePath() || cnf.indexInterval != h.cnf.indexInterval) {
+		nh := handler{cnf: &cnf, w: &logFile{}, st: h.st}
+		cnf.configureLogFile(nh.w)
+		err = nh.mkLogDir()
+		if err == nil && cnf.ringFiles {
+			err = cnf.prepareRing()
+		}
+		if err != nil {
+			return err
+		}
+		err = nh.openLogFile()
+		if err != nil {
+			return err
+		}
+		if !h.st.degraded {
+			err = h.w.Close()
+			if err != nil {
+				nh.w.Close()
+				return fmt.Errorf("%w: %w", ErrClose, err)
+			}
+		}
+		// Replace the file in place, as the formatters write to h.w.
+		*h.w = *nh.w
+		h.st.degraded = false
+	} else {
+		err = h.w.Flush()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrWrite, err)
+		}
+		cnf.configureLogFile(h.w)
+	}
+	*h.cnf = cnf
+	if opened := h.st.opened.Load(); opened != nil {
+		h.st.opened.Store(&fileOpening{at: opened.at, clock: cnf.clock})
+	}
+	if h.st.dirCache != nil {
+		h.st.dirCache.close()
+		h.st.dirCache = nil
+	}
+	if h.cnf.watchLogDir {
+		h.st.dirCache = newDirCache(h.cnf.logDir)
+	}
+	return nil
+}
+
+// Pause implements the method of the Handler interface.
+func (h handler) Pause() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.st.pausedAt.IsZero() {
+		h.st.pausedAt = h.cnf.clock()
+	}
+}
+
+// Resume implements the method of the Handler interface.
+func (h handler) Resume() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.st.pausedAt = time.Time{}
+	if h.st.closed {
+		return nil
+	}
+	err := h.prepareFile()
+	if err != nil {
+		h.reportError(err)
+	}
+	return err
+}
+
+// paused reports whether rotation is suppressed by Pause,
+// ending the pause if it exceeded MaxPause.
+func (h handler) paused() bool {
+	if h.st.pausedAt.IsZero() {
+		return false
+	}
+	if h.cnf.maxPause > 0 && h.cnf.clock().Sub(h.st.pausedAt) >= h.cnf.maxPause {
+		h.st.pausedAt = time.Time{}
+		h.meta(slog.LevelWarn, "rotation pause expired", "maxPause", h.cnf.maxPause)
+		return false
+	}
+	return true
+}
+
+func (h *handler) reopenLogFile() error {
+	h.w.Close()
+	return h.openLogFile()
+}
+
+// Rotate implements the method of the Handler interface.
+func (h handler) Rotate() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.st.closed {
+		return ErrClosed
+	}
+	if h.st.degraded || h.st.deferred != nil || h.paused() {
+		return nil
+	}
+	return h.rotate(RotateManual)
+}
+
+// Flush implements the method of the Handler interface.
+func (h handler) Flush() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.st.closed || h.st.degraded || h.st.deferred != nil {
+		return nil
+	}
+	err := h.w.Flush()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	return nil
+}
+
+// Reopen implements the method of the Handler interface.
+func (h handler) Reopen() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.st.closed {
+		return ErrClosed
+	}
+	if h.st.degraded || h.st.deferred != nil {
+		return nil
+	}
+	return h.reopenLogFile()
+}
+
+// Enabled implements the method of the slog.Handler interface
+// by calling the same method of the formatter habdler.
+func (h handler) Enabled(ctx context.Context, level slog.Level) bool {
+	if h.levelVar != nil && level < h.levelVar.Level() {
+		return false
+	}
+	if h.enabled != nil && !h.enabled(ctx) {
+		return false
+	}
+	return h.formatter.Enabled(ctx, level)
+}
+
+// Handle implements the method of the slog.Handler interface.
+func (h handler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.derived != nil {
+		h.formatter = h.derived.resolve(h.formatter)
+	}
+	return h.handleRecord(ctx, r)
+}
+
+// HandleBatch implements the method of the Handler interface.
+func (h handler) HandleBatch(ctx context.Context, rs []slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.derived != nil {
+		h.formatter = h.derived.resolve(h.formatter)
+	}
+	var errs []error
+	for _, r := range rs {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		err := h.handleRecord(ctx, r)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// handleRecord handles r, reporting the error, if any, and
+// passing the record to the OverflowHandler, then passes it
+// to the handlers of the ExtraFormat formats.
+func (h handler) handleRecord(ctx context.Context, r slog.Record) error {
+	err := h.handle(ctx, r)
+	h.updateHealth(err)
+	if err != nil {
+		h.reportError(err)
+		if h.overflow != nil && h.overflow.Enabled(ctx, r.Level) {
+			h.st.intervalStats.Diverted++
+			h.overflow.Handle(ctx, r)
+		} else {
+			h.drop(dropError)
+		}
+	}
+	if h.extras != nil {
+		return errors.Join(err, h.handleExtraFormats(ctx, r))
+	}
+	return err
+}
+
+// sourceAttr returns the AddSource attribute for the program counter pc.
+func sourceAttr(pc uintptr) slog.Attr {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	return slog.String(slog.SourceKey, frame.File+":"+strconv.Itoa(frame.Line))
+}
+
+// reportError passes err to the OnError function and the meta logger.
+func (h handler) reportError(err error) {
+	h.st.intervalStats.Errors++
+	if h.cnf.metrics != nil {
+		h.cnf.metrics.RecordError(err)
+	}
+	if h.cnf.onError != nil {
+		h.cnf.onError(err)
+	}
+	h.meta(slog.LevelError, "log error", "error", err)
+}
+
+// meta logs a lifecycle event to the meta logger, if any.
+func (h handler) meta(level slog.Level, msg string, args ...any) {
+	if h.cnf.metaLogger != nil {
+		h.cnf.metaLogger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// closeSyslog closes the connection to the system logger, if any.
+func (h handler) closeSyslog() {
+	if h.st.syslog != nil {
+		h.st.syslog.Close()
+		h.st.syslog = nil
+	}
+}
+
+func (h handler) handle(ctx context.Context, r slog.Record) error {
+	if h.st.closed {
+		switch h.cnf.onClosedWrite {
+		case ClosedDiscard:
+			return nil
+		case ClosedError:
+			return ErrClosed
+		}
+		return h.write(ctx, r)
+	}
+
+	err := h.prepareFile()
+	if h.cnf.sequenceKey != "" {
+		h.st.sequence++
+		r.AddAttrs(slog.Uint64(h.cnf.sequenceKey, h.st.sequence))
+	}
+	if h.cnf.totalKey != "" {
+		r.AddAttrs(slog.Uint64(h.cnf.totalKey, totalRecords.Add(1)))
+	}
+	if h.cnf.addSource && r.PC != 0 {
+		r.AddAttrs(sourceAttr(r.PC))
+	}
+	if err != nil {
+		return err
+	}
+	if h.cnf.rateLimit > 0 && !h.allow(r) {
+		h.drop(dropRateLimit)
+		return nil
+	}
+	if h.st.deferred != nil {
+		return h.deferRecord(ctx, r)
+	}
+	return h.writeFile(ctx, r)
+}
+
+// writeFile writes r to the current log file, once the
+// file is prepared and the record attributes are added.
+func (h handler) writeFile(ctx context.Context, r slog.Record) error {
+	if h.st.late != nil && h.isLate(r.Time) {
+		return h.writeLate(ctx, r)
+	}
+
+	err := h.w.IndexRecord(r.Time)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+
+	var start time.Time
+	if h.cnf.metrics != nil {
+		start = time.Now()
+	}
+	size := h.w.Size()
+	err = h.write(ctx, r)
+	if err != nil {
+		return err
+	}
+	if h.w.Size() == size {
+		// The formatter dropped the record, e.g. sampling it out.
+		h.drop(dropFiltered)
+		return nil
+	}
+	if payload := h.w.Size() - size - h.cnf.framingOverhead(); payload > 0 {
+		h.st.payloadSize += payload
+	}
+	h.st.intervalStats.Records++
+	if written := h.w.Size() - size; written > 0 {
+		h.st.intervalStats.Bytes += uint64(written)
+	}
+	recordTime := r.Time
+	if recordTime.IsZero() {
+		recordTime = time.Now()
+	}
+	if h.st.firstRecordTime.IsZero() && !h.st.resumedFile {
+		h.st.firstRecordTime = recordTime
+	}
+	h.st.lastRecordTime = recordTime
+	h.st.fileRecords++
+	if h.cnf.metrics != nil {
+		h.cnf.metrics.RecordWrite(int(h.w.Size()-size), time.Since(start))
+	}
+	if h.st.tail != nil {
+		h.st.tail.publish(h.buf.Bytes()[h.cnf.framingOverhead():])
+	}
+
+	h.st.unsynced = true
+	if h.cnf.syncAbove != nil && r.Level >= *h.cnf.syncAbove {
+		err = h.syncFile()
+		if err != nil {
+			return err
+		}
+	}
+	if h.w.Buffered() > 0 {
+		h.scheduleFlush()
+	}
+	return nil
+}
+
+// prepareFile performs the checks preceding the write of a
+// record, rotating the current log file if needed.
+func (h handler) prepareFile() error {
+	if h.st.deferred != nil {
+		return nil
+	}
+	if h.st.degraded {
+		h.retryOpen()
+		return nil
+	}
+
+	if h.cnf.minFreeBytes > 0 {
+		err := h.checkFreeSpace()
+		if err != nil {
+			return err
+		}
+	}
+
+	paused := h.paused()
+
+	if h.cnf.timeNamedCurrent() && !paused && h.w.Path() != h.cnf.currentFilePath() {
+		err := h.switchDailyFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.cnf.detectExtRotation {
+		err := h.checkExternalRotation()
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.cnf.rotateEvery > 0 && !paused {
+		err := h.checkBucket()
+		if err != nil {
+			return err
+		}
+	}
+
+	if h.cnf.maxFileSize > 0 && !paused && h.fileSize() > int64(h.cnf.maxFileSize) &&
+		(h.cnf.minRotationGap <= 0 || h.cnf.clock().Sub(h.st.lastRotation) >= h.cnf.minRotationGap) {
+		err := h.rotate(RotateSize)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkBucket rotates the current log file when the time
+// bucket it belongs to, according to RotateEvery, is over.
+func (h handler) checkBucket() error {
+	bucket := h.cnf.bucketStart(h.cnf.clock())
+	if h.st.bucketStart.IsZero() {
+		h.st.bucketStart = bucket
+		return nil
+	}
+	if !bucket.After(h.st.bucketStart) {
+		return nil
+	}
+	if h.cnf.skipEmptyRotation && h.w.Size() == 0 {
+		h.st.bucketStart = bucket
+		return nil
+	}
+	err := h.rotate(RotateInterval)
+	h.st.bucketStart = bucket
+	return err
+}
+
+// rotate renames the current log file to a rotated file name,
+// removes the oldest rotated file if needed and opens a new current file.
+func (h handler) rotate(reason RotationReason) (err error) {
+	if h.cnf.metrics != nil {
+		defer h.recordRotation(reason, time.Now(), &err)
+	}
+	h.st.lastRotation = h.cnf.clock()
+	if h.cnf.ringFiles {
+		return h.rotateRing(reason)
+	}
+	if h.cnf.numbered {
+		return h.rotateNumbered(reason)
+	}
+	err = h.finishFile()
+	if err != nil {
+		return err
+	}
+	size := h.w.Size()
+	err = h.w.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClose, err)
+	}
+	currentFilePath := h.cnf.currentFilePath()
+	name, err := h.rotatedName(reason, size)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRotateRename, err)
+	}
+	if h.cnf.rotatedSink != nil {
+		err = h.sinkFile(currentFilePath, name)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrRotateRename, err)
+		}
+		h.meta(slog.LevelInfo, "rotated log file", "from", currentFilePath, "to", name)
+		h.emitEvent(reason, currentFilePath, name, size)
+		return h.startFile(reason, name)
+	}
+	rotatedFileDir, err := h.rotatedFileDir()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRotateRename, err)
+	}
+	rotatedFilePath := filepath.Join(rotatedFileDir, name)
+	err = os.Rename(currentFilePath, rotatedFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// The current file was removed, possibly along with the log
+		// directory: there is nothing left to rotate.
+		h.meta(slog.LevelWarn, "current log file vanished before rotation", "path", currentFilePath)
+		return h.startFile(reason, "")
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRotateRename, err)
+	}
+	if h.cnf.indexInterval > 0 {
+		err = os.Rename(currentFilePath+INDEX_FILE_EXTENSION, rotatedFilePath+INDEX_FILE_EXTENSION)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrRotateRename, err)
+		}
+	}
+	if h.cnf.writeMetadata {
+		err = h.writeMetadataFile(rotatedFilePath, size)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrWrite, err)
+		}
+	}
+	if h.st.dirCache != nil {
+		h.st.dirCache.remove(filepath.Base(currentFilePath))
+		if rotatedFileDir == h.cnf.logDir {
+			h.st.dirCache.add(filepath.Base(rotatedFilePath))
+		}
+	}
+	h.meta(slog.LevelInfo, "rotated log file", "from", currentFilePath, "to", rotatedFilePath)
+	h.emitEvent(reason, currentFilePath, rotatedFilePath, size)
+	if reason == RotateInterval && h.cnf.lateWriteGrace > 0 && h.cnf.encryptionKey == nil {
+		h.keepLate(rotatedFilePath)
+	}
+	if h.cnf.bundle {
+		h.bundleRotatedFiles()
+	}
+
+	err = h.cleanup()
+	if err != nil {
+		return err
+	}
+
+	err = h.startFile(reason, filepath.Base(rotatedFilePath))
+	if err == nil && h.cnf.encryptionKey != nil {
+		h.encryptInBackground(rotatedFilePath)
+	}
+	return err
+}
+
+// rotatedName returns the name of the rotated file for the current
+// log file, rotated because of reason with final size size.
+func (h handler) rotatedName(reason RotationReason, size int64) (string, error) {
+	now := h.cnf.clock()
+	if h.cnf.rotatedNameFunc == nil {
+		rotationTime := now
+		if reason == RotateInterval {
+			rotationTime = h.st.bucketStart
+		} else if h.cnf.nameFromFirst && !h.st.firstRecordTime.IsZero() {
+			rotationTime = h.st.firstRecordTime
+		}
+		return h.cnf.rotatedFileName(rotationTime), nil
+	}
+	name := h.cnf.rotatedNameFunc(h.rotationInfo(now, size))
+	if !h.cnf.isRotatedFileName(name) || (h.cnf.confine && (!filepath.IsLocal(name) || filepath.Base(name) != name)) {
+		return "", fmt.Errorf("invalid rotated file name %q", name)
+	}
+	return name, nil
+}
+
+// rotationInfo returns the statistics of the current
+// log file, rotated at now with final size size.
+func (h handler) rotationInfo(now time.Time, size int64) RotationInfo {
+	return RotationInfo{
+		Time:        now,
+		FirstRecord: h.st.firstRecordTime,
+		LastRecord:  h.st.lastRecordTime,
+		Bytes:       size,
+		Records:     h.st.fileRecords,
+	}
+}
+
+// sinkFile copies the file at path to the rotated sink
+// writer for name and removes it, with its index file.
+func (h handler) sinkFile(path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	w := h.cnf.rotatedSink(name)
+	_, err = io.Copy(w, f)
+	f.Close()
+	cerr := w.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path + INDEX_FILE_EXTENSION)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if h.st.dirCache != nil {
+		h.st.dirCache.remove(filepath.Base(path))
+	}
+	return nil
+}
+
+// finishFile writes the trailer record, if enabled, to the current log file
+// before it is closed, and syncs it if SyncInterval is set. The trailer is
+// formatted without the attributes and groups of derived handlers.
+func (h handler) finishFile() error {
+	if h.cnf.carryOverBytes > 0 && h.w.Size() > 0 {
+		err := h.captureTail()
+		if err != nil {
+			h.meta(slog.LevelWarn, "cannot carry over log file tail", "path", h.w.Path(), "error", err)
+		}
+	}
+	if h.cnf.writeTrailer {
+		r := slog.NewRecord(time.Now(), h.cnf.level(), trailerMessage, 0)
+		r.AddAttrs(
+			slog.Uint64("records", h.st.fileRecords),
+			slog.Int64("bytes", h.w.Size()),
+		)
+		root := h
+		root.formatter = h.st.formatter
+		err := root.write(context.Background(), r)
+		if err != nil {
+			return err
+		}
+	}
+	if h.cnf.syncInterval > 0 && h.st.unsynced {
+		return h.syncFile()
+	}
+	return nil
+}
+
+// newFile resets the per file state after a new current log file is started.
+func (h handler) newFile() {
+	if h.cnf.resetSequence {
+		h.st.sequence = 0
+	}
+}
+
+// startFile opens the new current log file after a rotation because of
+// reason of the previous current file, now named prev, and writes the
+// chain header and carry-over records, if enabled. They are formatted
+// without the attributes and groups of derived handlers.
+func (h handler) startFile(reason RotationReason, prev string) error {
+	h.newFile()
+	err := h.openLogFile()
+	if err != nil {
+		return err
+	}
+	root := h
+	root.formatter = h.st.formatter
+	if h.cnf.chainHeaders {
+		r := slog.NewRecord(time.Now(), h.cnf.level(), headerMessage, 0)
+		r.AddAttrs(
+			slog.String("prev", prev),
+			slog.Time("rotatedAt", h.cnf.clock()),
+			slog.String("reason", reason.String()),
+		)
+		err = root.write(context.Background(), r)
+		if err != nil {
+			return err
+		}
+	}
+	if h.st.carryOver != nil {
+		r := slog.NewRecord(time.Now(), h.cnf.level(), carryOverMessage, 0)
+		r.AddAttrs(
+			slog.String("prev", prev),
+			slog.String("data", string(h.st.carryOver)),
+		)
+		h.st.carryOver = nil
+		return root.write(context.Background(), r)
+	}
+	return nil
+}
+
+// captureTail keeps the last CarryOverBytes bytes of the current log file,
+// to be carried over to the next one by startFile.
+func (h handler) captureTail() error {
+	err := h.w.Flush()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(h.w.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n := min(int64(h.cnf.carryOverBytes), h.w.Size())
+	tail := make([]byte, n)
+	_, err = f.ReadAt(tail, h.w.Size()-n)
+	if err != nil {
+		return err
+	}
+	h.st.carryOver = tail
+	return nil
+}
+
+// scheduleFlush arranges for buffered records to be
+// flushed when the coalescing window expires.
+func (h handler) scheduleFlush() {
+	if h.st.flushPending {
+		return
+	}
+	h.st.flushPending = true
+	time.AfterFunc(h.cnf.coalesceWindow, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.st.flushPending = false
+		err := h.w.Flush()
+		if err != nil {
+			h.reportError(fmt.Errorf("%w: %w", ErrWrite, err))
+		}
+	})
+}
+
+// switchDailyFile closes the file of the previous day
+// and starts the file of the current one.
+func (h handler) switchDailyFile() (err error) {
+	if h.cnf.metrics != nil {
+		defer h.recordRotation(RotateDaily, time.Now(), &err)
+	}
+	err = h.finishFile()
+	if err != nil {
+		return err
+	}
+	path, size := h.w.Path(), h.w.Size()
+	err = h.w.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrClose, err)
+	}
+	h.emitEvent(RotateDaily, path, path, size)
+	if h.cnf.writeMetadata {
+		err = h.writeMetadataFile(path, size)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrWrite, err)
+		}
+	}
+
+	err = h.cleanup()
+	if err != nil {
+		return err
+	}
+
+	return h.startFile(RotateDaily, filepath.Base(path))
+}
+
+// write formats the record to the current log file, retrying
+// up to the configured number of attempts.
+func (h handler) write(ctx context.Context, r slog.Record) (err error) {
+	if h.buf != nil {
+		err = h.format(ctx, r)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrWrite, err)
+		}
+		if h.oversized() {
+			switch h.cnf.oversizedPolicy {
+			case OversizedDivert:
+				err = h.divertRecord()
+				if err != nil {
+					return fmt.Errorf("%w: %w", ErrWrite, err)
+				}
+				return nil
+			case OversizedTruncate:
+				h.truncateRecord()
+			}
+		}
+	}
+	// A failed attempt resumes from the bytes already written,
+	// which the reopened file keeps, so they are not duplicated.
+	var written int
+	for i := 0; i < h.cnf.writeAttempts; i++ {
+		if i > 0 {
+			if h.st.closed || !transient(err) {
+				break
+			}
+			time.Sleep(h.cnf.writeBackoff)
+			err = h.reopenLogFile()
+			if err != nil {
+				continue
+			}
+		}
+		var n int
+		n, err = h.writeRecord(ctx, r, written)
+		written += n
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// writeRecord writes the record to the current log file, skipping the
+// first offset bytes of the record formatted in the handler buffer.
+func (h handler) writeRecord(ctx context.Context, r slog.Record, offset int) (n int, err error) {
+	if h.buf == nil {
+		err = h.formatter.Handle(ctx, r)
+	} else if h.buf.Len() > offset {
+		n, err = h.w.Write(h.buf.Bytes()[offset:])
+	}
+	if err != nil {
+		return n, fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	return n, nil
+}
+
+// transient reports whether the write error err can go away,
+// so that the write is worth retrying after reopening the file.
+func transient(err error) bool {
+	for _, target := range []error{
+		os.ErrClosed,
+		syscall.EINTR,
+		syscall.EAGAIN,
+		syscall.EIO,
+		syscall.ENOSPC,
+		syscall.EDQUOT,
+		syscall.ESTALE,
+		syscall.ENOENT,
+		syscall.EBADF,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup applies the retention limits after a rotation,
+// unless CleanupSchedule defers it to a later rotation.
+func (h *handler) cleanup() error {
+	h.st.pendingCleanups++
+	if !h.cleanupDue() {
+		return nil
+	}
+	return h.runCleanup()
+}
+
+// cleanupDue reports whether the cleanup deferred by
+// CleanupSchedule must run at the current rotation.
+func (h *handler) cleanupDue() bool {
+	if h.cnf.cleanupEvery <= 1 && h.cnf.cleanupInterval <= 0 {
+		return true
+	}
+	if h.cnf.cleanupEvery > 0 && h.st.pendingCleanups >= h.cnf.cleanupEvery {
+		return true
+	}
+	return h.cnf.cleanupInterval > 0 && h.cnf.clock().Sub(h.st.lastCleanup) >= h.cnf.cleanupInterval
+}
+
+// runCleanup applies the retention limits now.
+func (h *handler) runCleanup() error {
+	h.st.pendingCleanups = 0
+	h.st.lastCleanup = h.cnf.clock()
+	return h.searchAndRemoveOldestFile()
+}
+
+func (h *handler) searchAndRemoveOldestFile() error {
+	files, err := h.listRotatedFiles()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCleanup, err)
+	}
+
+	// More than one file is over the limit when CleanupSchedule
+	// deferred the cleanup of previous rotations.
+	if uint64(len(files)) > h.cnf.maxRotatedFiles {
+		sort.Slice(files, func(i, j int) bool {
+			if files[i].time.Equal(files[j].time) {
+				return files[i].path < files[j].path
+			}
+			return files[i].time.Before(files[j].time)
+		})
+		excess := uint64(len(files)) - h.cnf.maxRotatedFiles
+		for _, f := range files[:excess] {
+			err = h.removeRotatedFile(f.path)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrCleanup, err)
+			}
+		}
+		files = files[excess:]
+	}
+
+	if h.cnf.maxAge < DEFAULT_MAX_AGE {
+		expiry := h.cnf.clock().Add(-h.cnf.maxAge)
+		for _, f := range files {
+			if !f.time.Before(expiry) {
+				continue
+			}
+			err = h.removeRotatedFile(f.path)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrCleanup, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rotatedFile is a rotated file found by listRotatedFiles.
+type rotatedFile struct {
+	path string
+	time time.Time
+}
+
+// listRotatedFiles returns the rotated files of the log directories with
+// their age, computed from their names, falling back to their modification
+// time only for names not following DateTimeLayout, so that no stat call is
+// needed for the usual date-named files.
+func (h *handler) listRotatedFiles() ([]rotatedFile, error) {
+	var files []rotatedFile
+	for i := 0; ; i++ {
+		dir := h.cnf.spillDir(i)
+		var err error
+		files, err = h.listRotatedFilesIn(dir, files)
+		if i > 0 && errors.Is(err, fs.ErrNotExist) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.cnf.maxFilesPerDir <= 0 {
+			return files, nil
+		}
+	}
+}
+
+// listRotatedFilesIn appends the rotated files of dir to files.
+func (h *handler) listRotatedFilesIn(dir string, files []rotatedFile) ([]rotatedFile, error) {
+	match := h.retainedFileMatcher(dir)
+	if h.st.dirCache != nil && dir == h.cnf.logDir {
+		cached, err := h.st.dirCache.list(match)
+		if err != nil {
+			return files, err
+		}
+		for name, modTime := range cached {
+			t, ok := h.cnf.retainedFileTime(name)
+			if !ok {
+				t = modTime
+			}
+			files = append(files, rotatedFile{path: filepath.Join(dir, name), time: t})
+		}
+		return files, nil
+	}
+
+	err := h.scanDir(dir, func(name string) error {
+		if !match(name) {
+			return nil
+		}
+		path := filepath.Join(dir, name)
+		t, ok := h.cnf.retainedFileTime(name)
+		if !ok {
+			info, err := os.Lstat(path)
+			if err != nil {
+				return err
+			}
+			t = info.ModTime()
+		}
+		files = append(files, rotatedFile{path: path, time: t})
+		return nil
+	})
+	return files, err
+}
+
+// retainedFileTime returns the time a rotated file or bundle is aged by,
+// if it can be parsed from its name.
+func (cnf *config) retainedFileTime(name string) (time.Time, bool) {
+	t, ok := cnf.rotatedFileTime(name)
+	if !ok && cnf.isBundleFileName(name) {
+		return cnf.bundleTime(name)
+	}
+	return t, ok
+}
+
+// retainedFileMatcher returns a function reporting whether the file of dir
+// with the given name is a rotated file or a bundle subject to retention:
+// the file kept open by LateWriteGrace is neither deleted nor truncated and
+// recycled until it is closed.
+func (h *handler) retainedFileMatcher(dir string) func(name string) bool {
+	var late string
+	if h.st.late != nil {
+		late = filepath.Clean(h.st.late.Name())
+	}
+	return func(name string) bool {
+		return (h.cnf.isRotatedFileName(name) || h.cnf.isBundleFileName(name)) &&
+			(late == "" || filepath.Join(dir, name) != late)
+	}
+}
+
+// countRotatedFilesIn returns the number of rotated files in dir.
+func (h *handler) countRotatedFilesIn(dir string) (uint64, error) {
+	var n uint64
+	err := h.scanDir(dir, func(name string) error {
+		if h.cnf.isRotatedFileName(name) {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// scanDir calls fn with the name of every entry of dir, in directory order.
+// Unlike os.ReadDir, it reads the entries in batches of dirReadBatch names,
+// so that large directories are never held in memory at once, nor sorted.
+func (h *handler) scanDir(dir string, fn func(name string) error) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		names, err := f.Readdirnames(h.cnf.dirReadBatch)
+		for _, name := range names {
+			err := fn(name)
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// oldestRotatedFile returns the path of the oldest rotated file
+// and the number of rotated files found in the log directories.
+func (h *handler) oldestRotatedFile() (string, uint64, error) {
+	var n uint64
+	var oldestPath string
+	var oldestTime time.Time
+	for i := 0; ; i++ {
+		dir := h.cnf.spillDir(i)
+		path, modTime, k, err := h.oldestRotatedFileIn(dir)
+		if i > 0 && errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", 0, err
+		}
+		if k > 0 && (oldestPath == "" || modTime.Before(oldestTime)) {
+			oldestPath, oldestTime = path, modTime
+		}
+		n += k
+		if h.cnf.maxFilesPerDir <= 0 {
+			break
+		}
+	}
+	return oldestPath, n, nil
+}
+
+// oldestRotatedFileIn returns the path and modification time of the
+// oldest rotated file in dir and the number of rotated files found there.
+func (h *handler) oldestRotatedFileIn(dir string) (string, time.Time, uint64, error) {
+	match := h.retainedFileMatcher(dir)
+	if h.st.dirCache != nil && dir == h.cnf.logDir {
+		name, n, modTime, err := h.st.dirCache.oldest(match)
+		if err != nil || n == 0 {
+			return "", time.Time{}, 0, err
+		}
+		return filepath.Join(dir, name), modTime, n, nil
+	}
+
+	var n uint64
+	var oldestName string
+	var oldestTime time.Time
+	err := h.scanDir(dir, func(name string) error {
+		if !match(name) {
+			return nil
+		}
+		n++
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		// Names break ties, so that the choice does not depend on directory order.
+		modTime := info.ModTime()
+		if oldestName == "" || modTime.Before(oldestTime) || (modTime.Equal(oldestTime) && name < oldestName) {
+			oldestName, oldestTime = name, modTime
+		}
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, 0, err
+	}
+
+	if oldestName == "" {
+		return "", time.Time{}, 0, nil
+	}
+	return filepath.Join(dir, oldestName), oldestTime, n, nil
+}
+
+// rotatedFileDir returns the directory where the next rotated file is
+// placed, creating it if needed: the first one, among the log directory
+// and its numbered siblings, holding less than maxFilesPerDir rotated files.
+func (h handler) rotatedFileDir() (string, error) {
+	if h.cnf.maxFilesPerDir <= 0 {
+		return h.cnf.logDir, nil
+	}
+	for i := 0; ; i++ {
+		dir := h.cnf.spillDir(i)
+		n, err := h.countRotatedFilesIn(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return dir, os.MkdirAll(dir, DEFAULT_DIR_MODE)
+		}
+		if err != nil {
+			return "", err
+		}
+		if n < uint64(h.cnf.maxFilesPerDir) {
+			return dir, nil
+		}
+	}
+}
+
+// removeRotatedFile removes a rotated file along with its index file,
+// according to the RetentionMode and DeleteAfter options. Bundles
+// are always deleted.
+func (h *handler) removeRotatedFile(path string) error {
+	if h.cnf.isBundleFileName(filepath.Base(path)) {
+		return h.deleteRotatedFile(path)
+	}
+	if h.cnf.retentionMode == RetentionTruncate {
+		recycled, err := h.truncateRotatedFile(path)
+		if err != nil || recycled {
+			return err
+		}
+	}
+	if h.cnf.deleteAfter > 0 && (h.cnf.maxPendingTasks <= 0 || len(h.st.deletions) < h.cnf.maxPendingTasks) {
+		return h.markRotatedFile(path)
+	}
+	return h.deleteRotatedFile(path)
+}
+
+// truncateRotatedFile truncates a rotated file and makes it the spare file,
+// removing its index file. If a spare file already exists the rotated file
+// is left untouched and recycled is false.
+func (h *handler) truncateRotatedFile(path string) (recycled bool, err error) {
+	sparePath := h.cnf.filePath(h.cnf.spareFileName())
+	_, err = os.Lstat(sparePath)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	err = os.Truncate(path, 0)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(path, sparePath)
+	if err != nil {
+		return false, err
+	}
+	err = removeSidecars(path)
+	if err != nil {
+		return false, err
+	}
+	if h.st.dirCache != nil && filepath.Dir(path) == filepath.Clean(h.cnf.logDir) {
+		h.st.dirCache.remove(filepath.Base(path))
+	}
+	h.meta(slog.LevelInfo, "truncated rotated log file", "path", path)
+	return true, nil
+}
+
+// recycleSpareFile renames the spare file, if any, to path,
+// unless a file already exists there.
+func (h *handler) recycleSpareFile(path string) error {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = os.Rename(h.cnf.filePath(h.cnf.spareFileName()), path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// markRotatedFile marks a rotated file, along with its index
+// file, for deletion after the DeleteAfter grace period.
+func (h *handler) markRotatedFile(path string) error {
+	markedPath := path + DELETED_FILE_EXTENSION
+	err := os.Rename(path, markedPath)
+	if err != nil {
+		return err
+	}
+	for _, ext := range sidecarExtensions {
+		err = os.Rename(path+ext, path+ext+DELETED_FILE_EXTENSION)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	now := time.Now()
+	err = os.Chtimes(markedPath, now, now)
+	if err != nil {
+		return err
+	}
+	if h.st.dirCache != nil && filepath.Dir(path) == filepath.Clean(h.cnf.logDir) {
+		h.st.dirCache.remove(filepath.Base(path))
+	}
+	h.meta(slog.LevelInfo, "marked rotated log file for deletion", "path", path)
+	h.scheduleDeletion(markedPath, now.Add(h.cnf.deleteAfter))
+	return nil
+}
+
+// scheduleMarkedFiles deletes the files marked for deletion whose grace
+// period has expired and schedules the deletion of the other ones.
+func (h *handler) scheduleMarkedFiles() error {
+	for i := 0; ; i++ {
+		dir := h.cnf.spillDir(i)
+		err := h.scanDir(dir, func(markedName string) error {
+			name := strings.TrimSuffix(markedName, DELETED_FILE_EXTENSION)
+			if name == markedName || !h.cnf.isRotatedFileName(name) {
+				return nil
+			}
+			markedPath := filepath.Join(dir, markedName)
+			info, err := os.Lstat(markedPath)
+			if err != nil {
+				return err
+			}
+			due := info.ModTime().Add(h.cnf.deleteAfter)
+			if time.Now().Before(due) {
+				h.scheduleDeletion(markedPath, due)
+				return nil
+			}
+			return h.deleteMarkedFile(markedPath)
+		})
+		if i > 0 && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.cnf.maxFilesPerDir <= 0 {
+			return nil
+		}
+	}
+}
+
+// scheduleDeletion arranges for the marked file at markedPath to be deleted at due.
+func (h handler) scheduleDeletion(markedPath string, due time.Time) {
+	if _, ok := h.st.deletions[markedPath]; ok {
+		return
+	}
+	h.st.deletions[markedPath] = time.AfterFunc(time.Until(due), func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.st.deletions[markedPath]; !ok {
+			return
+		}
+		delete(h.st.deletions, markedPath)
+		err := h.deleteMarkedFile(markedPath)
+		if err != nil {
+			h.reportError(fmt.Errorf("%w: %w", ErrCleanup, err))
+		}
+	})
+}
+
+// deleteMarkedFile deletes a file marked for deletion along with its sidecar files.
+func (h *handler) deleteMarkedFile(markedPath string) error {
+	err := os.Remove(markedPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	path := strings.TrimSuffix(markedPath, DELETED_FILE_EXTENSION)
+	for _, ext := range sidecarExtensions {
+		err = os.Remove(path + ext + DELETED_FILE_EXTENSION)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	h.meta(slog.LevelInfo, "removed rotated log file", "path", path)
+	return nil
+}
+
+// deleteRotatedFile deletes a rotated file along with its sidecar files.
+func (h *handler) deleteRotatedFile(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+	err = removeSidecars(path)
+	if err != nil {
+		return err
+	}
+	if h.st.dirCache != nil && filepath.Dir(path) == filepath.Clean(h.cnf.logDir) {
+		h.st.dirCache.remove(filepath.Base(path))
+	}
+	h.meta(slog.LevelInfo, "removed rotated log file", "path", path)
+	return nil
+}
+
+// sidecarExtensions are the extensions appended to the names of the log
+// files to name their sidecar files, which follow them when they are
+// renamed and removed.
+var sidecarExtensions = []string{INDEX_FILE_EXTENSION, METADATA_FILE_EXTENSION}
+
+// removeSidecars removes the sidecar files of the log file at path.
+func removeSidecars(path string) error {
+	for _, ext := range sidecarExtensions {
+		err := os.Remove(path + ext)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFreeSpace verifies that the log volume has at least minFreeBytes
+// available, deleting rotated files when it does not. The outcome is
+// cached for freeSpaceCheckInterval.
+func (h handler) checkFreeSpace() error {
+	now := time.Now()
+	if now.Sub(h.st.lastSpaceCheck) >= freeSpaceCheckInterval {
+		h.st.lastSpaceCheck = now
+		low, err := h.lowFreeSpace()
+		if err != nil {
+			return err
+		}
+		for low {
+			oldestFilePath, n, err := h.oldestRotatedFile()
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrCleanup, err)
+			}
+			if n == 0 {
+				break
+			}
+			err = h.deleteRotatedFile(oldestFilePath)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrCleanup, err)
+			}
+			low, err = h.lowFreeSpace()
+			if err != nil {
+				return err
+			}
+		}
+		h.st.lowSpace = low
+	}
+
+	if h.st.lowSpace {
+		return ErrLowFreeSpace
+	}
+	return nil
+}
+
+// checkExternalRotation reopens the current log file if its path no longer
+// refers to the open file. The check is performed at most once every
+// externalRotationCheckInterval.
+func (h handler) checkExternalRotation() error {
+	now := h.cnf.clock()
+	if now.Sub(h.st.lastRotationCheck) < externalRotationCheckInterval {
+		return nil
+	}
+	h.st.lastRotationCheck = now
+
+	info, err := os.Stat(h.cnf.currentFilePath())
+	if err == nil {
+		openInfo, err := h.w.Stat()
+		if err != nil {
+			return err
+		}
+		if os.SameFile(info, openInfo) {
+			return nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	h.emitEvent(RotateExternal, h.w.Path(), "", h.w.Size())
+	return h.reopenLogFile()
+}
+
+func (h handler) lowFreeSpace() (bool, error) {
+	free, err := freeSpace(h.cnf.logDir)
+	if err != nil {
+		return false, err
+	}
+	return free < h.cnf.minFreeBytes, nil
+}
+
+func (h handler) clone() *handler {
+	return &handler{
+		formatter: h.formatter,
+		cnf:       h.cnf,
+		mu:        h.mu,
+		w:         h.w,
+		buf:       h.buf,
+		st:        h.st,
+		levelVar:  h.levelVar,
+		lazy:      h.lazy,
+		derived:   h.derived,
+		overflow:  h.overflow,
+		extras:    h.extras,
+		enabled:   h.enabled,
+	}
+}
+
+// WithAttrs implements the method of the slog.Handler interface by
+// cloning the current handler and calling the WithAttrs of the
+// formatter handler.
+func (h handler) WithAttrs(attr []slog.Attr) slog.Handler {
+	nh := h.clone()
+	if h.overflow != nil {
+		nh.overflow = h.overflow.WithAttrs(attr)
+	}
+	if h.extras != nil {
+		nh.extras = make([]slog.Handler, len(h.extras))
+		for i, x := range h.extras {
+			nh.extras[i] = x.WithAttrs(attr)
+		}
+	}
+	if h.lazy {
+		if len(attr) > 0 {
+			nh.derived = h.derive(derivationOp{attrs: attr})
+		}
+		return nh
+	}
+	nh.formatter = h.formatter.WithAttrs(attr)
+	return nh
+}
+
+// WithGroup implements the method of the slog.Handler interface by
+// cloning the current handler and calling the WithGroup of the
+// formatter handler.
+func (h handler) WithGroup(name string) slog.Handler {
+	nh := h.clone()
+	if h.overflow != nil {
+		nh.overflow = h.overflow.WithGroup(name)
+	}
+	if h.extras != nil {
+		nh.extras = make([]slog.Handler, len(h.extras))
+		for i, x := range h.extras {
+			nh.extras[i] = x.WithGroup(name)
+		}
+	}
+	if h.lazy {
+		nh.derived = h.derive(derivationOp{group: name})
+		return nh
+	}
 	nh.formatter = h.formatter.WithGroup(name)
 	return nh
 }
@@ -6,14 +6,19 @@ package rotoslog
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 )
 
-func getLogger() *slog.Logger {
-	h, err := NewHandler(MaxRotatedFiles(1), LogHandlerBuilder(slog.NewTextHandler))
+func getLogger(options ...optFun) *slog.Logger {
+	options = append([]optFun{MaxRotatedFiles(1), LogHandlerBuilder(slog.NewTextHandler)}, options...)
+	h, err := NewHandler(options...)
 	if err != nil {
 		panic(err)
 	}
@@ -35,6 +40,54 @@ func BenchmarkLog(b *testing.B) {
 	}
 }
 
+func BenchmarkLogNoLock(b *testing.B) {
+	ctx := context.TODO()
+	logger := getLogger(NoLock()).With("N", b.N)
+	for n := 0; n < b.N; n++ {
+		l := randomLevel()
+		logger.Log(ctx, l, "tanto va la gatta al lardo che ci lascia lo zampino")
+	}
+}
+
+func benchmarkWithAttrs(b *testing.B, options ...optFun) {
+	ctx := context.TODO()
+	logger := getLogger(options...)
+	for n := 0; n < b.N; n++ {
+		l := logger.With("n", n, "request", "tanto va la gatta al lardo")
+		if n%100 == 0 {
+			l.Log(ctx, slog.LevelInfo, "che ci lascia lo zampino")
+		}
+	}
+}
+
+func BenchmarkWithAttrs(b *testing.B) {
+	benchmarkWithAttrs(b)
+}
+
+func BenchmarkWithAttrsLazy(b *testing.B) {
+	benchmarkWithAttrs(b, LazyDerive(true))
+}
+
+func benchmarkNewHandler(b *testing.B, options ...optFun) {
+	options = append([]optFun{LogDir(b.TempDir())}, options...)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		h, err := NewHandler(options...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		h.Close()
+	}
+}
+
+func BenchmarkNewHandler(b *testing.B) {
+	benchmarkNewHandler(b)
+}
+
+func BenchmarkNewHandlerLazyFormatter(b *testing.B) {
+	benchmarkNewHandler(b, LazyFormatter(true))
+}
+
 func BenchmarkParallelLog(b *testing.B) {
 	ctx := context.TODO()
 	logger := getLogger().With("N", b.N)
@@ -46,6 +99,17 @@ func BenchmarkParallelLog(b *testing.B) {
 	})
 }
 
+func BenchmarkParallelLogCoalesce(b *testing.B) {
+	ctx := context.TODO()
+	logger := getLogger(CoalesceWindow(time.Millisecond)).With("N", b.N)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l := randomLevel()
+			logger.Log(ctx, l, "tanto va la gatta al lardo che ci lascia lo zampino")
+		}
+	})
+}
+
 func parallelLog(k, n int) {
 	if n <= 0 {
 		return
@@ -113,3 +177,28 @@ func BenchmarkParallelLog16(b *testing.B) {
 		parallelLog(16, 256)
 	}
 }
+
+func BenchmarkRetentionScan(b *testing.B) {
+	dir := b.TempDir()
+	for i := 0; i < 20000; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%08d.log", i))
+		err := os.WriteFile(name, nil, 0644)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	h, err := NewHandler(LogDir(dir), MaxRotatedFiles(1<<20))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+	hh := h.(handler)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		err = hh.searchAndRemoveOldestFile()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -5,12 +5,32 @@
 package rotoslog
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	formatter "github.com/samber/slog-formatter"
 )
 
 func init() {
@@ -86,3 +106,3710 @@ func TestHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestWriteRetry(t *testing.T) {
+	var errs []error
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		WriteRetry(2, time.Millisecond),
+		OnError(func(err error) { errs = append(errs, err) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+
+	// Simulate a transient failure by closing the file behind the handler's back.
+	h.(handler).w.file.Close()
+	logger.Info("retried msg")
+
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	cnf := h.(handler).cnf
+	l, err := countLinesInFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 1 {
+		t.Fatalf("wrong number of lines: got %d, expected 1", l)
+	}
+
+	h, err = NewHandler(
+		LogDir(t.TempDir()),
+		OnError(func(err error) { errs = append(errs, err) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.(handler).w.file.Close()
+	slog.New(h).Info("lost msg")
+	if len(errs) != 1 || !errors.Is(errs[0], ErrWrite) || !errors.Is(errs[0], os.ErrClosed) {
+		t.Fatalf("got errors %v, expected %v", errs, ErrWrite)
+	}
+
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{fmt.Errorf("%w: %w", ErrWrite, os.ErrClosed), true},
+		{&fs.PathError{Op: "write", Path: "current.log", Err: syscall.ENOSPC}, true},
+		{&fs.PathError{Op: "open", Path: "current.log", Err: syscall.EACCES}, false},
+		{&fs.PathError{Op: "write", Path: "current.log", Err: syscall.EFBIG}, false},
+		{errors.New("format error"), false},
+	} {
+		if transient(tc.err) != tc.transient {
+			t.Fatalf("wrong transient(%v): got %t, expected %t", tc.err, !tc.transient, tc.transient)
+		}
+	}
+}
+
+func TestErrDirCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewHandler(LogDir(filepath.Join(path, "log")))
+	if !errors.Is(err, ErrDirCreate) {
+		t.Fatalf("got error %v, expected %v", err, ErrDirCreate)
+	}
+}
+
+func TestLogConfigOnStart(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		LogConfigOnStart(true),
+		HandlerOptions(slog.HandlerOptions{Level: slog.LevelError}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnf := h.(handler).cnf
+	buf, err := os.ReadFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"level":"ERROR"`, `"msg":"rotoslog configuration"`, `"maxRotatedFiles":8`, `"format":"*slog.JSONHandler"`} {
+		if !bytes.Contains(buf, []byte(s)) {
+			t.Fatalf("%q not found in %s", s, buf)
+		}
+	}
+}
+
+func TestMinFreeBytes(t *testing.T) {
+	var errs []error
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		MinFreeBytes(maxUint64),
+		OnError(func(err error) { errs = append(errs, err) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("dropped msg")
+
+	if len(errs) != 1 || !errors.Is(errs[0], ErrLowFreeSpace) {
+		t.Fatalf("got errors %v, expected %v", errs, ErrLowFreeSpace)
+	}
+	if size := h.(handler).w.Size(); size != 0 {
+		t.Fatalf("wrong file size: got %d, expected 0", size)
+	}
+}
+
+func TestLengthPrefixFraming(t *testing.T) {
+	const N = 10
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		Framing(LengthPrefix),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < N; i++ {
+		logger.Info("framed msg", "i", i)
+	}
+
+	cnf := h.(handler).cnf
+	buf, err := os.ReadFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for len(buf) > 0 {
+		l := int(binary.BigEndian.Uint32(buf))
+		record := buf[4 : 4+l]
+		if !bytes.Contains(record, []byte(fmt.Sprintf(`"i":%d`, n))) {
+			t.Fatalf("unexpected record %d: %s", n, record)
+		}
+		buf = buf[4+l:]
+		n++
+	}
+	if n != N {
+		t.Fatalf("wrong number of records: got %d, expected %d", n, N)
+	}
+}
+
+func TestDetectExternalRotation(t *testing.T) {
+	now := time.Now()
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		DetectExternalRotation(true),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("before rotation")
+
+	cnf := h.(handler).cnf
+	rotatedFilePath := cnf.filePath("rotated.log")
+	err = os.Rename(cnf.currentFilePath(), rotatedFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(externalRotationCheckInterval)
+	logger.Info("after rotation")
+
+	for _, path := range []string{rotatedFilePath, cnf.currentFilePath()} {
+		l, err := countLinesInFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != 1 {
+			t.Fatalf("%s has the wrong number of lines: got %d, expected 1", path, l)
+		}
+	}
+}
+
+func TestTimeKeyAndFormat(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		TimeKey("ts"),
+		TimeFormat(TIME_FORMAT_UNIX_MILLI),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("timed msg")
+
+	cnf := h.(handler).cnf
+	buf, err := os.ReadFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^{"ts":\d+,`).Match(buf) {
+		t.Fatalf("unexpected record: %s", buf)
+	}
+}
+
+func TestWithLevelVar(t *testing.T) {
+	var level slog.LevelVar
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		WithLevelVar(&level),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("logged msg")
+	level.Set(slog.LevelWarn)
+	logger.Info("dropped msg")
+	logger.Warn("logged msg")
+	level.Set(slog.LevelInfo)
+	logger.Info("logged msg")
+
+	cnf := h.(handler).cnf
+	l, err := countLinesInFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 3 {
+		t.Fatalf("wrong number of lines: got %d, expected 3", l)
+	}
+}
+
+func TestDailyFileIsCurrent(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		FilePrefix("app-"),
+		DailyFileIsCurrent(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("daily msg")
+
+	cnf := h.(handler).cnf
+	path := cnf.filePath("app-" + time.Now().Format(DEFAULT_DAILY_FILE_LAYOUT) + ".log")
+	l, err := countLinesInFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 1 {
+		t.Fatalf("wrong number of lines: got %d, expected 1", l)
+	}
+}
+
+func TestCurrentNameFunc(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	h, err := NewHandler(
+		LogDir(dir),
+		FilePrefix("app-"),
+		MaxRotatedFiles(1),
+		CurrentNameFunc(func(now time.Time) string { return now.Format("2006010215") }),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for _, name := range []string{"app-2023100112.log", "app-2023100113.log", "app-2023100114.log"} {
+		logger.Info("hourly msg")
+		l, err := countLinesInFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != 1 {
+			t.Fatalf("wrong number of lines in %s: got %d, expected 1", name, l)
+		}
+		now = now.Add(time.Hour)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of files: got %d, expected 2", len(entries))
+	}
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	const N = 10
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		CoalesceWindow(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < N; i++ {
+		logger.Info("coalesced msg", "i", i)
+	}
+
+	cnf := h.(handler).cnf
+	l, err := countLinesInFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 0 {
+		t.Fatalf("wrong number of lines before flush: got %d, expected 0", l)
+	}
+	time.Sleep(300 * time.Millisecond)
+	l, err = countLinesInFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != N {
+		t.Fatalf("wrong number of lines after flush: got %d, expected %d", l, N)
+	}
+}
+
+func TestOnClosedWrite(t *testing.T) {
+	var errs []error
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		OnClosedWrite(ClosedError),
+		OnError(func(err error) { errs = append(errs, err) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("logged msg")
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("late msg")
+
+	if len(errs) != 1 || !errors.Is(errs[0], ErrClosed) {
+		t.Fatalf("got errors %v, expected %v", errs, ErrClosed)
+	}
+	cnf := h.(handler).cnf
+	l, err := countLinesInFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 1 {
+		t.Fatalf("wrong number of lines: got %d, expected 1", l)
+	}
+}
+
+func TestWriteIndex(t *testing.T) {
+	const interval = 256
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		WriteIndex(interval),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 64; i++ {
+		logger.Info("indexed msg", "i", i)
+	}
+
+	cnf := h.(handler).cnf
+	buf, err := os.ReadFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []int64
+	var next int64
+	for offset := 0; offset < len(buf); {
+		if int64(offset) >= next {
+			expected = append(expected, int64(offset))
+			next = (int64(offset)/interval + 1) * interval
+		}
+		offset += bytes.IndexByte(buf[offset:], '\n') + 1
+	}
+
+	index, err := os.ReadFile(cnf.currentFilePath() + INDEX_FILE_EXTENSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != len(expected)*indexEntrySize {
+		t.Fatalf("wrong index size: got %d, expected %d", len(index), len(expected)*indexEntrySize)
+	}
+	for i, offset := range expected {
+		got := int64(binary.BigEndian.Uint64(index[i*indexEntrySize:]))
+		if got != offset {
+			t.Fatalf("wrong offset in entry %d: got %d, expected %d", i, got, offset)
+		}
+	}
+}
+
+func TestMetaLogger(t *testing.T) {
+	var meta bytes.Buffer
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		MaxFileSize(256),
+		MaxRotatedFiles(1),
+		DateTimeLayout("20060102150405.000000000"),
+		MetaLogger(slog.New(slog.NewTextHandler(&meta, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 32; i++ {
+		logger.Info("meta msg", "i", i)
+	}
+
+	for _, s := range []string{`msg="rotated log file"`, `msg="removed rotated log file"`} {
+		if !bytes.Contains(meta.Bytes(), []byte(s)) {
+			t.Fatalf("%q not found in %s", s, meta.Bytes())
+		}
+	}
+}
+
+func TestSyslogMeta(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(LogDir(dir), SyslogMeta(true))
+	if err != nil {
+		t.Skipf("syslog not available: %v", err)
+	}
+	st := h.(handler).st
+	conn := st.syslog
+	err = h.Reconfigure(LogDir(dir), SyslogMeta(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.syslog != conn {
+		t.Fatal("syslog connection replaced")
+	}
+	err = h.Reconfigure(LogDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.syslog != nil {
+		t.Fatal("syslog connection not closed")
+	}
+	err = h.Reconfigure(LogDir(dir), SyslogMeta(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	if st.syslog != nil {
+		t.Fatal("syslog connection not closed")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(LogDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("a", 1)
+	logger.Info("first msg")
+
+	err = h.Reconfigure(LogDir(dir), DateTimeLayout(""))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got error %v, expected %v", err, ErrInvalidConfig)
+	}
+	logger.Info("second msg")
+
+	err = h.Reconfigure(LogDir(dir), FilePrefix("new-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("third msg")
+
+	for path, expected := range map[string]int{
+		filepath.Join(dir, "current.log"):     2,
+		filepath.Join(dir, "new-current.log"): 1,
+	} {
+		l, err := countLinesInFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != expected {
+			t.Fatalf("%s has the wrong number of lines: got %d, expected %d", path, l, expected)
+		}
+	}
+}
+
+func TestNewHandlerInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, option := range []optFun{
+		DateTimeLayout(""),
+		WithClock(nil),
+		CurrentFileSuffix(""),
+	} {
+		_, err := NewHandler(LogDir(dir), option)
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("got error %v, expected %v", err, ErrInvalidConfig)
+		}
+	}
+}
+
+func TestOpenSyncMode(t *testing.T) {
+	for _, mode := range []SyncMode{SyncNone, SyncData, SyncFull} {
+		h, err := NewHandler(LogDir(t.TempDir()), OpenSyncMode(mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := slog.New(h)
+		logger.Info("synced msg")
+		err = h.Reopen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Info("synced msg")
+		err = h.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := countLinesInFile(h.(handler).cnf.currentFilePath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != 2 {
+			t.Fatalf("sync mode %d: wrong number of lines: got %d, expected 2", mode, l)
+		}
+	}
+
+	_, err := NewHandler(LogDir(t.TempDir()), OpenSyncMode(SyncFull+1))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("got error %v, expected %v", err, ErrInvalidConfig)
+	}
+}
+
+func TestWatchLogDir(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		FilePrefix("w-"),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(256),
+		MaxRotatedFiles(2),
+		WatchLogDir(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	countFiles := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	for i := 0; i < 32; i++ {
+		logger.Info("watched msg", "i", i)
+	}
+	if n := countFiles(); n != 3 {
+		t.Fatalf("wrong number of files: got %d, expected 3", n)
+	}
+
+	// An older file created by another process must be the first to go.
+	externalFilePath := filepath.Join(dir, "w-external.log")
+	err = os.WriteFile(externalFilePath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(externalFilePath, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "linux" {
+		h.(handler).st.dirCache.invalidate(false)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 8; i++ {
+		logger.Info("watched msg", "i", i)
+	}
+	if _, err := os.Stat(externalFilePath); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("%s was not removed: %v", externalFilePath, err)
+	}
+}
+
+func TestSequenceKey(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(512),
+		MaxRotatedFiles(16),
+		SequenceKey("seq"),
+		ResetSequenceOnNewFile(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 32; i++ {
+		logger.With("i", i).Info("sequenced msg")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("wrong number of files: got %d, expected at least 2", len(entries))
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, line := range bytes.Split(bytes.TrimSpace(buf), []byte{'\n'}) {
+			if !bytes.Contains(line, []byte(fmt.Sprintf(`"seq":%d}`, i+1))) {
+				t.Fatalf("wrong sequence number in %s line %d: %s", path, i+1, line)
+			}
+		}
+	}
+}
+
+func TestTotalKey(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	var loggers []*slog.Logger
+	for _, dir := range dirs {
+		h, err := NewHandler(LogDir(dir), SequenceKey("seq"), TotalKey("total"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		loggers = append(loggers, slog.New(h))
+	}
+	start := totalRecords.Load()
+	for i := 0; i < 4; i++ {
+		loggers[i%2].Info("counted msg")
+	}
+
+	for i, dir := range dirs {
+		buf, err := os.ReadFile(filepath.Join(dir, "current.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, line := range bytes.Split(bytes.TrimSpace(buf), []byte{'\n'}) {
+			expected := fmt.Sprintf(`"seq":%d,"total":%d}`, j+1, start+uint64(2*j+i+1))
+			if !bytes.Contains(line, []byte(expected)) {
+				t.Fatalf("wrong counters in %s line %d: got %s, expected %s", dir, j+1, line, expected)
+			}
+		}
+	}
+}
+
+func TestAddSource(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		AddSource(true),
+		WrapHandler(func(w io.Writer) slog.Handler {
+			return slog.NewTextHandler(w, nil)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	_, file, line, _ := runtime.Caller(0)
+	slog.New(h).Info("located msg")
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("source=%s:%d", file, line+1)
+	if !bytes.Contains(data, []byte(expected)) {
+		t.Fatalf("unexpected log data: got %q, expected %q", data, expected)
+	}
+}
+
+func TestResumeSize(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		h, err := NewHandler(LogDir(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cnf := h.(handler).cnf
+		info, err := os.Stat(cnf.currentFilePath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := h.(handler).w.Size(); size != info.Size() {
+			t.Fatalf("wrong size after restart %d: got %d, expected %d", i, size, info.Size())
+		}
+		slog.New(h).Info("resumed msg", "i", i)
+		err = h.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResumeRecordCount(t *testing.T) {
+	dir := t.TempDir()
+	options := []optFun{
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(512),
+		MaxRotatedFiles(16),
+		ChainHeaders(true),
+		WriteTrailer(true),
+	}
+	for i := 0; i < 2; i++ {
+		h, err := NewHandler(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := slog.New(h)
+		for j := 0; j < 8; j++ {
+			logger.Info("resumed msg", "i", i, "j", j)
+		}
+		err = h.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// Leave a partial line, as after a crash.
+			f, err := os.OpenFile(filepath.Join(dir, "current.log"), os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.WriteString(`{"partial":`)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := false
+	for _, entry := range entries {
+		if entry.Name() == "current.log" {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumed = resumed || bytes.Contains(buf, []byte(`{"partial":`))
+		lines := bytes.Split(bytes.TrimSpace(buf), []byte{'\n'})
+		records := 0
+		for _, line := range lines {
+			if !bytes.Contains(line, []byte("rotoslog header")) && !bytes.Contains(line, []byte("rotoslog trailer")) {
+				records++
+			}
+		}
+		expected := fmt.Sprintf(`"records":%d,`, records)
+		if trailer := lines[len(lines)-1]; !bytes.Contains(trailer, []byte(expected)) {
+			t.Fatalf("wrong trailer in %s: got %s, expected %s", entry.Name(), trailer, expected)
+		}
+	}
+	if !resumed {
+		t.Fatal("the resumed file was not rotated")
+	}
+}
+
+func TestMaxFilesPerDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(128),
+		MaxRotatedFiles(5),
+		MaxFilesPerDir(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 64; i++ {
+		logger.Info("spilled msg", "i", i)
+	}
+
+	rotated := 0
+	for _, path := range []string{dir, dir + ".1", dir + ".2"} {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, entry := range entries {
+			if entry.Name() != "current.log" {
+				n++
+			}
+		}
+		if n > 2 {
+			t.Fatalf("too many rotated files in %s: got %d, expected at most 2", path, n)
+		}
+		rotated += n
+	}
+	if rotated != 5 {
+		t.Fatalf("wrong number of rotated files: got %d, expected 5", rotated)
+	}
+}
+
+func TestWriteTrailer(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(512),
+		MaxRotatedFiles(16),
+		WriteTrailer(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 32; i++ {
+		logger.Info("counted msg", "i", i)
+	}
+
+	cnf := h.(handler).cnf
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("wrong number of files: got %d, expected at least 2", len(entries))
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if path == cnf.currentFilePath() {
+			continue
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.Split(bytes.TrimSpace(buf), []byte{'\n'})
+		trailer := lines[len(lines)-1]
+		content := len(buf) - len(trailer) - 1
+		expected := fmt.Sprintf(`"records":%d,"bytes":%d}`, len(lines)-1, content)
+		if !bytes.Contains(trailer, []byte(expected)) {
+			t.Fatalf("wrong trailer in %s: got %s, expected %s", path, trailer, expected)
+		}
+	}
+}
+
+func TestNameFromFirstRecordAndMaxAge(t *testing.T) {
+	const layout = "20060102150405.000000000"
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout(layout),
+		MaxFileSize(1),
+		MaxRotatedFiles(16),
+		MaxAge(time.Hour),
+		NameFromFirstRecord(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	old := time.Now().Add(-2 * time.Hour)
+	for i, recordTime := range []time.Time{old, old.Add(time.Second), time.Now(), time.Now()} {
+		r := slog.NewRecord(recordTime, slog.LevelInfo, "dated msg", 0)
+		r.AddAttrs(slog.Int("i", i))
+		err = h.Handle(ctx, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every write rotates the previous file, which is named after its record
+	// and immediately deleted if the record is older than MaxAge.
+	if _, err := os.Stat(filepath.Join(dir, old.Format(layout)+".log")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired file was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, old.Add(time.Second).Format(layout)+".log")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired file was not removed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of files: got %d, expected 2", len(entries))
+	}
+}
+
+// openDescriptors returns the number of file descriptors of
+// the process open on path, skipping the test if it cannot tell.
+func openDescriptors(t *testing.T, path string) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open file descriptors cannot be listed")
+	}
+	n := 0
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err == nil && target == path {
+			n++
+		}
+	}
+	return n
+}
+
+// testOpenCleanup checks that NewHandler, failing with option once the
+// current file of dir is open, closes it and releases its path.
+func testOpenCleanup(t *testing.T, dir string, option optFun) {
+	_, err := NewHandler(LogDir(dir), OnDuplicatePath(DuplicateError), option)
+	if !errors.Is(err, ErrLink) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := openDescriptors(t, filepath.Join(dir, "current.log")); n != 0 {
+		t.Fatalf("current file left open %d times", n)
+	}
+	h, err := NewHandler(LogDir(dir), OnDuplicatePath(DuplicateError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+}
+
+func TestHardLinkLatestFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not maintained on Windows")
+	}
+	dir := t.TempDir()
+	// The link cannot replace a non-empty directory.
+	err := os.MkdirAll(filepath.Join(dir, "latest.log", "sub"), DEFAULT_DIR_MODE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOpenCleanup(t, dir, HardLinkLatest("latest.log"))
+}
+
+func TestCurrentPointerFileFailure(t *testing.T) {
+	dir := t.TempDir()
+	// The pointer file cannot replace a non-empty directory.
+	err := os.MkdirAll(filepath.Join(dir, "CURRENT", "sub"), DEFAULT_DIR_MODE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testOpenCleanup(t, dir, CurrentPointerFile("CURRENT"))
+}
+
+func TestHardLinkLatest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links are not maintained on Windows")
+	}
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(256),
+		HardLinkLatest("latest.log"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 16; i++ {
+		logger.Info("linked msg", "i", i)
+	}
+
+	cnf := h.(handler).cnf
+	currentInfo, err := os.Stat(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkInfo, err := os.Stat(filepath.Join(dir, "latest.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(currentInfo, linkInfo) {
+		t.Fatal("latest.log does not link to the current file")
+	}
+
+	c := *cnf
+	c.hardLinkLatest = "20"
+	for name, rotated := range map[string]bool{
+		"20":                          false,
+		"20.tmp":                      false,
+		c.rotatedFileName(time.Now()): true,
+	} {
+		if c.isRotatedFileName(name) != rotated {
+			t.Fatalf("wrong isRotatedFileName(%q): expected %t", name, rotated)
+		}
+	}
+}
+
+func TestCurrentPointerFile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	h, err := NewHandler(
+		LogDir(dir),
+		CurrentNameFunc(func(now time.Time) string { return now.Format("2006010215") }),
+		CurrentPointerFile("CURRENT"),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for _, name := range []string{"2023100112.log", "2023100113.log"} {
+		logger.Info("pointed msg")
+		data, err := os.ReadFile(filepath.Join(dir, "CURRENT"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != name+"\n" {
+			t.Fatalf("wrong current pointer: got %q, expected %q", data, name+"\n")
+		}
+		now = now.Add(time.Hour)
+	}
+
+	c := *h.(handler).cnf
+	c.currentPointer = "20"
+	for name, rotated := range map[string]bool{
+		"20":                          false,
+		"20.tmp":                      false,
+		c.rotatedFileName(time.Now()): true,
+	} {
+		if c.isRotatedFileName(name) != rotated {
+			t.Fatalf("wrong isRotatedFileName(%q): expected %t", name, rotated)
+		}
+	}
+}
+
+func TestExtraFormat(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(64),
+		MaxRotatedFiles(2),
+		ExtraFormat(".txt", slog.NewTextHandler),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("k", "v")
+	for i := 0; i < 8; i++ {
+		logger.Info("fanned out msg", "i", i)
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var json, text int
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".txt.log") {
+			text++
+		} else {
+			json++
+		}
+	}
+	if json != 3 || text != 3 {
+		t.Fatalf("wrong number of files: got %d JSON and %d text, expected 3 and 3", json, text)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "current.txt.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`msg="fanned out msg" k=v i=7`)) {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+}
+
+func TestExtraFormatSideEffects(t *testing.T) {
+	dir := t.TempDir()
+	ticks := make(chan time.Time)
+	collector := &testCollector{}
+	h, err := NewHandler(
+		LogDir(dir),
+		Heartbeat(time.Minute, slog.LevelInfo, "heartbeat"),
+		WithMetrics(collector),
+		ExtraFormat(".txt", slog.NewTextHandler),
+		withTicks(ticks),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("fanned out msg", "i", i)
+	}
+	ticks <- time.Now()
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"msg":"heartbeat"`)) {
+		t.Fatalf("missing heartbeat in main file: %q", data)
+	}
+	lines := bytes.Count(data, []byte("\n"))
+	if collector.writes != lines {
+		t.Fatalf("wrong number of writes: got %d, expected %d", collector.writes, lines)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "current.txt.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 3 {
+		t.Fatalf("wrong number of lines in extra file: got %d, expected 3: %q", n, data)
+	}
+}
+
+func TestExtraFormatReconfigure(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		LogConfigOnStart(true),
+		ExtraFormat(".txt", slog.NewTextHandler),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	data, err := os.ReadFile(filepath.Join(dir, "current.txt.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+
+	newDir := t.TempDir()
+	err = h.Reconfigure(LogDir(newDir), MaxFileSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 4; i++ {
+		logger.Info("reconfigured msg", "i", i)
+	}
+	entries, err := os.ReadDir(newDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text int
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".txt.log") {
+			text++
+		}
+	}
+	if text < 2 {
+		t.Fatalf("extra format not reconfigured: got %d text files", text)
+	}
+}
+
+func TestDeleteAfter(t *testing.T) {
+	dir := t.TempDir()
+	options := []optFun{
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+		MaxRotatedFiles(1),
+		DeleteAfter(time.Hour),
+	}
+	h, err := NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("deferred msg", "i", i)
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countMarked := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), DELETED_FILE_EXTENSION) {
+				n++
+			}
+		}
+		return n
+	}
+	if n := countMarked(); n != 1 {
+		t.Fatalf("wrong number of marked files: got %d, expected 1", n)
+	}
+
+	// Pretend the grace period expired while the handler was not running.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, entry := range entries {
+		err = os.Chtimes(filepath.Join(dir, entry.Name()), old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err = NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if n := countMarked(); n != 0 {
+		t.Fatalf("wrong number of marked files: got %d, expected 0", n)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+		MaxRotatedFiles(DEFAULT_EVENTS_BUFFER*2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	n := DEFAULT_EVENTS_BUFFER + 10
+	for i := 0; i <= n; i++ {
+		logger.Info("event msg", "i", i)
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []RotationEvent
+	for ev := range h.Events() {
+		events = append(events, ev)
+	}
+	if len(events) != DEFAULT_EVENTS_BUFFER {
+		t.Fatalf("wrong number of events: got %d, expected %d", len(events), DEFAULT_EVENTS_BUFFER)
+	}
+	last := events[len(events)-1]
+	if last.Reason != RotateSize || last.OldPath != filepath.Join(dir, DEFAULT_CURRENT_FILE_NAME) || last.Bytes <= 0 {
+		t.Fatalf("unexpected event: %+v", last)
+	}
+	if _, err := os.Stat(last.NewPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetentionTruncate(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+		MaxRotatedFiles(1),
+		RetentionMode(RetentionTruncate),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("truncate msg 0")
+	logger.Info("truncate msg 1")
+
+	hh := h.(handler)
+	cnf := hh.cnf
+	oldest, n, err := hh.oldestRotatedFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("wrong number of rotated files: got %d, expected 1", n)
+	}
+	oldestInfo, err := os.Stat(oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("truncate msg 2")
+	_, n, err = hh.oldestRotatedFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("wrong number of rotated files: got %d, expected 1", n)
+	}
+	if _, err := os.Stat(cnf.filePath(cnf.spareFileName())); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("spare file not recycled: %v", err)
+	}
+	currentInfo, err := os.Stat(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(oldestInfo, currentInfo) {
+		t.Fatal("oldest rotated file not recycled as current file")
+	}
+	lines, err := countLinesInFile(cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines != 1 {
+		t.Fatalf("wrong number of lines in current file: got %d, expected 1", lines)
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.Local)
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		DailyFileIsCurrent(true),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("clock msg 0")
+	now = now.Add(24 * time.Hour)
+	logger.Info("clock msg 1")
+
+	cnf := h.(handler).cnf
+	for _, day := range []string{"2023-10-01", "2023-10-02"} {
+		data, err := os.ReadFile(cnf.filePath(day + ".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Records keep the slog time.
+		if !bytes.Contains(data, []byte(time.Now().Format("2006-01-02"))) {
+			t.Fatalf("unexpected record time in %s: %s", day, data)
+		}
+	}
+}
+
+func TestPause(t *testing.T) {
+	now := time.Now()
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+		MaxPause(200*time.Millisecond),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	hh := h.(handler)
+	logger := slog.New(h)
+
+	rotatedFiles := func() uint64 {
+		_, n, err := hh.oldestRotatedFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	h.Pause()
+	for i := 0; i < 3; i++ {
+		logger.Info("paused msg", "i", i)
+	}
+	if n := rotatedFiles(); n != 0 {
+		t.Fatalf("wrong number of rotated files while paused: got %d, expected 0", n)
+	}
+	err = h.Resume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := rotatedFiles(); n != 1 {
+		t.Fatalf("wrong number of rotated files after resume: got %d, expected 1", n)
+	}
+
+	h.Pause()
+	logger.Info("paused msg")
+	logger.Info("paused msg")
+	now = now.Add(300 * time.Millisecond)
+	logger.Info("expired pause msg")
+	if n := rotatedFiles(); n != 2 {
+		t.Fatalf("wrong number of rotated files after max pause: got %d, expected 2", n)
+	}
+}
+
+func TestWrapHandler(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		WrapHandler(func(w io.Writer) slog.Handler {
+			return slog.NewTextHandler(w, nil).WithAttrs([]slog.Attr{slog.String("app", "wrapped")})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	slog.New(h).Info("wrapped msg")
+
+	data, err := os.ReadFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`msg="wrapped msg" app=wrapped`)) {
+		t.Fatalf("unexpected log data: %s", data)
+	}
+}
+
+func TestFallbackToStderr(t *testing.T) {
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	err := os.WriteFile(blocker, nil, DEFAULT_FILE_MODE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	now := time.Now()
+	stderr := os.Stderr
+	os.Stderr = w
+	h, err := NewHandler(LogDir(blocker), FallbackToStderr(true), WithClock(func() time.Time { return now }))
+	os.Stderr = stderr
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("stderr msg")
+	w.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("stderr msg")) {
+		t.Fatalf("record not written to stderr: %q", data)
+	}
+
+	err = os.Remove(blocker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(fallbackRetryInterval)
+	logger.Info("file msg")
+	l, err := countLinesInFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 1 {
+		t.Fatalf("wrong number of lines: got %d, expected 1", l)
+	}
+}
+
+func TestFallbackDeleteAfter(t *testing.T) {
+	dir := t.TempDir()
+	// The current file cannot be opened while a directory takes its path.
+	err := os.Mkdir(filepath.Join(dir, "current.log"), DEFAULT_DIR_MODE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	h, err := NewHandler(
+		LogDir(dir),
+		FallbackToStderr(true),
+		DeleteAfter(time.Hour),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	markedPath := filepath.Join(dir, h.(handler).cnf.rotatedFileName(now.Add(-3*time.Hour))+DELETED_FILE_EXTENSION)
+	err = os.WriteFile(markedPath, nil, DEFAULT_FILE_MODE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-2 * time.Hour)
+	err = os.Chtimes(markedPath, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(fallbackRetryInterval)
+	slog.New(h).Info("file msg")
+	_, err = os.Stat(markedPath)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired marked file not deleted on recovery: %v", err)
+	}
+}
+
+func TestWithFormatters(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		WithFormatters(
+			formatter.FormatByKey("pwd", func(v slog.Value) slog.Value {
+				return slog.StringValue("***********")
+			}),
+			formatter.ErrorFormatter("error"),
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("login", "user", "admin", "pwd", "123456", "error", errors.New("bad password"))
+	h.Close()
+
+	data, err := os.ReadFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("123456")) || !bytes.Contains(data, []byte(`"pwd":"***********"`)) {
+		t.Fatalf("password not redacted: %q", data)
+	}
+	if !bytes.Contains(data, []byte(`"error":{"message":"bad password","type":"*errors.errorString"`)) {
+		t.Fatalf("error not formatted: %q", data)
+	}
+}
+
+func TestLazyDerive(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		LogHandlerBuilder(slog.NewTextHandler),
+		LazyDerive(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h).With("a", 1).WithGroup("g").With("b", 2)
+	logger.Info("lazy msg", "c", 3)
+	logger.Info("lazy msg", "c", 4)
+
+	data, err := os.ReadFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`msg="lazy msg" a=1 g.b=2 g.c=3`, `msg="lazy msg" a=1 g.b=2 g.c=4`} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Fatalf("%q not found in log data: %s", s, data)
+		}
+	}
+}
+
+// withTicks makes the background goroutines of a handler tick when
+// the test sends to ticks. As ticks is unbuffered, once a send returns
+// the goroutine is done with the previous tick.
+func withTicks(ticks chan time.Time) optFun {
+	return func(cnf *config) {
+		cnf.newTicker = func(time.Duration) (<-chan time.Time, func()) {
+			return ticks, func() {}
+		}
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	ticks := make(chan time.Time)
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		SyncInterval(20*time.Millisecond),
+		withTicks(ticks),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ticks <- time.Now()
+	ticks <- time.Now()
+	if stats := h.Stats(); !stats.LastSync.IsZero() {
+		t.Fatalf("unexpected sync of an unmodified file at %v", stats.LastSync)
+	}
+	start := time.Now()
+	slog.New(h).Info("synced msg")
+	ticks <- time.Now()
+	ticks <- time.Now()
+	if stats := h.Stats(); stats.LastSync.Before(start) {
+		t.Fatalf("wrong last sync time: got %v, expected after %v", stats.LastSync, start)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	ticks := make(chan time.Time)
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		Heartbeat(50*time.Millisecond, slog.LevelDebug, "heartbeat"),
+		withTicks(ticks),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fourth tick may race with Close.
+	for i := 0; i < 4; i++ {
+		ticks <- time.Now()
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := countLinesInFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l < 3 || l > 4 {
+		t.Fatalf("wrong number of heartbeats: got %d, expected 3 or 4", l)
+	}
+}
+
+func TestSizeAccounting(t *testing.T) {
+	dir := t.TempDir()
+	options := []optFun{
+		LogDir(dir),
+		Framing(LengthPrefix),
+		SizeAccounting(SizePayloadOnly),
+	}
+	h, err := NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("payload msg", "i", i)
+	}
+	hh := h.(handler)
+	expected := hh.w.Size() - 3*lengthPrefixSize
+	if size := hh.fileSize(); size != expected {
+		t.Fatalf("wrong payload size: got %d, expected %d", size, expected)
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload size of a resumed file is recomputed.
+	h, err = NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if size := h.(handler).fileSize(); size != expected {
+		t.Fatalf("wrong resumed payload size: got %d, expected %d", size, expected)
+	}
+}
+
+func TestStats(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("stats msg", "i", i)
+	}
+	stats := h.StatsAndReset()
+	if stats.Records != 3 || stats.Rotations != 2 || stats.Bytes == 0 || stats.Errors != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	logger.Info("stats msg")
+	interval := h.StatsAndReset()
+	if interval.Records != 1 || interval.Rotations != 1 {
+		t.Fatalf("unexpected interval stats: %+v", interval)
+	}
+	total := h.Stats()
+	if total.Records != 4 || total.Rotations != 3 || total.Bytes != stats.Bytes+interval.Bytes {
+		t.Fatalf("unexpected cumulative stats: %+v", total)
+	}
+}
+
+type memFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *memFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestWithRotatedSink(t *testing.T) {
+	files := map[string]*memFile{}
+	var names []string
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+		WithRotatedSink(func(name string) io.WriteCloser {
+			f := &memFile{}
+			files[name] = f
+			names = append(names, name)
+			return f
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("sink msg", "i", i)
+	}
+
+	if len(names) != 2 {
+		t.Fatalf("wrong number of rotated files: got %d, expected 2", len(names))
+	}
+	for i, name := range names {
+		f := files[name]
+		if !f.closed || !bytes.Contains(f.Bytes(), []byte(fmt.Sprintf(`"i":%d`, i))) {
+			t.Fatalf("unexpected rotated file %s: %q", name, f.Bytes())
+		}
+	}
+	hh := h.(handler)
+	_, n, err := hh.oldestRotatedFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("wrong number of rotated files on disk: got %d, expected 0", n)
+	}
+}
+
+func TestFileExt(t *testing.T) {
+	for ext, expected := range map[string]string{
+		"log":  "app-current.log",
+		".log": "app-current.log",
+		"":     "app-current",
+	} {
+		cnf := defaultConfig
+		FilePrefix("app-")(&cnf)
+		FileExt(ext)(&cnf)
+		if name := cnf.currentFileName(); name != expected {
+			t.Errorf("wrong current file name for extension %q: got %q, expected %q", ext, name, expected)
+		}
+	}
+}
+
+func TestLineNumbering(t *testing.T) {
+	dir := t.TempDir()
+	options := []optFun{LogDir(dir), LineNumbering(true)}
+	h, err := NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("numbered msg")
+	slog.New(h).Info("numbered msg")
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Numbering continues in a resumed file.
+	h, err = NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	slog.New(h).Info("numbered msg")
+
+	data, err := os.ReadFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong number of lines: got %d, expected 3", len(lines))
+	}
+	for i, line := range lines {
+		prefix := fmt.Sprintf("%06d| {", i+1)
+		if !strings.HasPrefix(line, prefix) {
+			t.Fatalf("line %d does not start with %q: %s", i, prefix, line)
+		}
+	}
+}
+
+// droppingHandler drops the records with message "drop".
+type droppingHandler struct {
+	slog.Handler
+}
+
+func (h droppingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Message == "drop" {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func TestDroppedRecords(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		LineNumbering(true),
+		WrapHandler(func(w io.Writer) slog.Handler {
+			return droppingHandler{slog.NewJSONHandler(w, nil)}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("keep")
+	logger.Info("drop")
+	logger.Info("keep")
+
+	data, err := os.ReadFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "000001| {") || !strings.HasPrefix(lines[1], "000002| {") {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+	if stats := h.Stats(); stats.Records != 2 {
+		t.Fatalf("wrong number of records: got %d, expected 2", stats.Records)
+	}
+}
+
+func TestSyncAbove(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		CoalesceWindow(time.Hour),
+		SyncAbove(slog.LevelError),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	path := h.(handler).cnf.currentFilePath()
+
+	logger.Info("buffered msg")
+	l, err := countLinesInFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 0 {
+		t.Fatalf("wrong number of lines before sync: got %d, expected 0", l)
+	}
+	logger.Error("last gasp")
+	l, err = countLinesInFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 2 {
+		t.Fatalf("wrong number of lines after sync: got %d, expected 2", l)
+	}
+}
+
+func TestMaxPendingTasks(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+		MaxRotatedFiles(1),
+		DeleteAfter(time.Hour),
+		MaxPendingTasks(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 5; i++ {
+		logger.Info("pending msg", "i", i)
+	}
+
+	if stats := h.Stats(); stats.PendingTasks != 1 {
+		t.Fatalf("wrong number of pending tasks: got %d, expected 1", stats.PendingTasks)
+	}
+	marked, err := filepath.Glob(filepath.Join(dir, "*"+DELETED_FILE_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marked) != 1 {
+		t.Fatalf("wrong number of marked files: got %d, expected 1", len(marked))
+	}
+}
+
+// rawHandler writes the record messages as they are.
+type rawHandler struct {
+	w io.Writer
+}
+
+func (h rawHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h rawHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h rawHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h rawHandler) Handle(_ context.Context, r slog.Record) error {
+	_, err := io.WriteString(h.w, r.Message)
+	return err
+}
+
+func TestEnsureTrailingNewline(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		EnsureTrailingNewline(true),
+		WrapHandler(func(w io.Writer) slog.Handler { return rawHandler{w} }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("first record")
+	logger.Info("second record\n\n")
+	logger.Info("third record\n")
+
+	data, err := os.ReadFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "first record\nsecond record\nthird record\n"; string(data) != expected {
+		t.Fatalf("unexpected log data: got %q, expected %q", data, expected)
+	}
+}
+
+func TestSingleLineRecords(t *testing.T) {
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		SingleLineRecords(true),
+		WrapHandler(func(w io.Writer) slog.Handler { return rawHandler{w} }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("first\nrecord\n")
+	logger.Info("second record")
+
+	data, err := os.ReadFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "first\\nrecord\nsecond record\n"; string(data) != expected {
+		t.Fatalf("unexpected log data: got %q, expected %q", data, expected)
+	}
+}
+
+func TestIncludeGenerationExtraFormat(t *testing.T) {
+	dir := t.TempDir()
+	for gen := 1; gen <= 2; gen++ {
+		h, err := NewHandler(
+			LogDir(dir),
+			FilePrefix("app-"),
+			IncludeGeneration(true),
+			ExtraFormat(".txt", slog.NewTextHandler),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slog.New(h).Info("generation msg")
+		h.Close()
+		for _, name := range []string{"app-gen%d-current.log", "app-gen%d-current.txt.log"} {
+			if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf(name, gen))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, GENERATION_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "2\n" {
+		t.Fatalf("wrong generation file: got %q, expected %q", data, "2\n")
+	}
+}
+
+func TestCheckDateTimeLayout(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		options []optFun
+		valid   bool
+	}{
+		{[]optFun{DateTimeLayout(DEFAULT_FILE_DATE_FORMAT)}, true},
+		{[]optFun{DateTimeLayout("20060102150405.000000000")}, true},
+		{[]optFun{DateTimeLayout("200601021504"), RotateEvery(15 * time.Minute)}, true},
+		{[]optFun{DateTimeLayout("200601021504")}, false},
+		{[]optFun{DateTimeLayout("150405")}, false},
+		{[]optFun{DateTimeLayout("20060102030405")}, false},
+		{[]optFun{DateTimeLayout("2006-01-02T15:04:05Z07:00 MST")}, true},
+		{[]optFun{DateTimeLayout("rotated")}, false},
+	} {
+		options := append([]optFun{LogDir(dir), CheckDateTimeLayout(true)}, tc.options...)
+		h, err := NewHandler(options...)
+		if tc.valid != (err == nil) {
+			t.Fatalf("unexpected error for %+v: %v", tc, err)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			continue
+		}
+		h.Close()
+	}
+
+	h, err := NewHandler(LogDir(dir), CheckDateTimeLayout(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	err = h.Reconfigure(LogDir(dir), CheckDateTimeLayout(true), DateTimeLayout("2006"))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestDeferredPersist(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "log")
+	h, err := NewHandler(LogDir(dir), DeferredPersist(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.New(h).Info("discarded msg")
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	h, err = NewHandler(LogDir(dir), DeferredPersist(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h).With("k", "v")
+	for i := 0; i < 10; i++ {
+		logger.Info("deferred msg", "i", i)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = h.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("direct msg")
+	err = h.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 2 || len(lines) > 4 {
+		t.Fatalf("wrong number of records: %s", data)
+	}
+	if !strings.Contains(lines[len(lines)-2], `"k":"v","i":9`) {
+		t.Fatalf("wrong last deferred record: %s", lines[len(lines)-2])
+	}
+	if !strings.Contains(lines[len(lines)-1], `"msg":"direct msg"`) {
+		t.Fatalf("wrong direct record: %s", lines[len(lines)-1])
+	}
+	if bytes.Contains(data, []byte(`"i":0`)) {
+		t.Fatalf("oldest record not evicted: %s", data)
+	}
+
+	// Records are formatted when they are handled, not when persisted.
+	dir = filepath.Join(t.TempDir(), "log")
+	h, err = NewHandler(LogDir(dir), DeferredPersist(1024), LineNumbering(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	s := &struct{ V int }{V: 1}
+	slog.New(h).Info("pointer msg", "s", s)
+	s.V = 2
+	err = h.Persist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("000001| ")) || !bytes.Contains(data, []byte(`"s":{"V":1}`)) {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+}
+
+func TestConfineToLogDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, option := range []optFun{
+		FilePrefix("../"),
+		FilePrefix("sub/app-"),
+		FileExt("log/.."),
+		DateTimeLayout("2006/01/02"),
+		HardLinkLatest("../latest.log"),
+		MaxFilesPerDir(2),
+	} {
+		_, err := NewHandler(LogDir(dir), ConfineToLogDir(true), option)
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	h, err := NewHandler(LogDir(dir), ConfineToLogDir(true), FilePrefix("app-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	err = h.Reconfigure(LogDir(dir), ConfineToLogDir(true), FilePrefix("../app-"))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRotatedNameFunc(t *testing.T) {
+	dir := t.TempDir()
+	var infos []RotationInfo
+	h, err := NewHandler(
+		LogDir(dir),
+		FilePrefix("app-"),
+		MaxFileSize(200),
+		RotatedNameFunc(func(info RotationInfo) string {
+			infos = append(infos, info)
+			return fmt.Sprintf("app-%d-%drecs.log", len(infos), info.Records)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 10; i++ {
+		logger.Info("named msg", "i", i)
+	}
+
+	if len(infos) == 0 {
+		t.Fatal("no rotation")
+	}
+	info := infos[0]
+	if info.Records == 0 || info.Bytes <= 200 || info.FirstRecord.IsZero() || info.LastRecord.Before(info.FirstRecord) {
+		t.Fatalf("unexpected rotation info: %+v", info)
+	}
+	name := fmt.Sprintf("app-1-%drecs.log", info.Records)
+	l, err := countLinesInFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != int(info.Records) {
+		t.Fatalf("wrong number of lines in %s: got %d, expected %d", name, l, info.Records)
+	}
+}
+
+func TestLiveTail(t *testing.T) {
+	h, err := NewHandler(LogDir(t.TempDir()), LiveTail(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	server := httptest.NewServer(h.TailHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("wrong content type: %q", ct)
+	}
+	slog.New(h).Info("tailed msg")
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "data: {") || !strings.Contains(line, `"msg":"tailed msg"`) {
+		t.Fatalf("unexpected event: %q", line)
+	}
+}
+
+func TestOnDuplicatePath(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(LogDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewHandler(LogDir(dir), OnDuplicatePath(DuplicateError))
+	if !errors.Is(err, ErrPathInUse) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other, err := NewHandler(LogDir(dir), FilePrefix("other-"), OnDuplicatePath(DuplicateError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	err = other.Reconfigure(LogDir(dir), OnDuplicatePath(DuplicateError))
+	if !errors.Is(err, ErrPathInUse) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = NewHandler(LogDir(dir), OnDuplicatePath(DuplicateError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+}
+
+func TestWriteMetadata(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(1),
+		MaxRotatedFiles(1),
+		WriteMetadata(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("metadata msg", "i", i)
+	}
+
+	sidecars, err := filepath.Glob(filepath.Join(dir, "*"+METADATA_FILE_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sidecar of the removed rotated file is removed too.
+	if len(sidecars) != 1 {
+		t.Fatalf("wrong number of metadata files: got %d, expected 1", len(sidecars))
+	}
+	data, err := os.ReadFile(sidecars[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md fileMetadata
+	err = json.Unmarshal(data, &md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(strings.TrimSuffix(sidecars[0], METADATA_FILE_EXTENSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.RecordCount != 1 || md.Bytes != info.Size() || md.StartTime == nil || md.PID != os.Getpid() || md.SchemaVersion != metadataSchemaVersion {
+		t.Fatalf("unexpected metadata: %s", data)
+	}
+}
+
+func TestRotateEvery(t *testing.T) {
+	for _, skipEmpty := range []bool{false, true} {
+		dir := t.TempDir()
+		now := time.Date(2023, 10, 1, 10, 5, 0, 0, time.Local)
+		h, err := NewHandler(
+			LogDir(dir),
+			DateTimeLayout("200601021504"),
+			RotateEvery(15*time.Minute),
+			SkipEmptyRotation(skipEmpty),
+			WithClock(func() time.Time { return now }),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := slog.New(h)
+		now = now.Add(15 * time.Minute)
+		logger.Info("bucket msg")
+		now = now.Add(30 * time.Minute)
+		logger.Info("bucket msg")
+		h.Close()
+
+		expected := []string{"202310011015.log", "current.log"}
+		if !skipEmpty {
+			expected = append([]string{"202310011000.log"}, expected...)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if fmt.Sprint(names) != fmt.Sprint(expected) {
+			t.Fatalf("wrong files with SkipEmptyRotation(%t): got %v, expected %v", skipEmpty, names, expected)
+		}
+	}
+}
+
+func TestLateWriteGrace(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2023, 10, 1, 10, 5, 0, 0, time.Local)
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("200601021504"),
+		RotateEvery(15*time.Minute),
+		LateWriteGrace(2*time.Minute),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := func(msg string, t time.Time) error {
+		return h.Handle(context.Background(), slog.NewRecord(t, slog.LevelInfo, msg, 0))
+	}
+	handle("first", now)
+	now = now.Add(11 * time.Minute)
+	handle("second", now)
+	handle("late", now.Add(-2*time.Minute))
+	now = now.Add(4 * time.Minute)
+	handle("too late", now.Add(-6*time.Minute))
+	h.Close()
+
+	for name, expected := range map[string][]string{
+		"202310011000.log": {`"msg":"first"`, `"msg":"late"`},
+		"current.log":      {`"msg":"second"`, `"msg":"too late"`},
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != len(expected) {
+			t.Fatalf("wrong number of records in %s: got %d, expected %d", name, len(lines), len(expected))
+		}
+		for i, line := range lines {
+			if !strings.Contains(line, expected[i]) {
+				t.Fatalf("unexpected record in %s: got %q, expected %s", name, line, expected[i])
+			}
+		}
+	}
+}
+
+func TestLateWriteGraceReconfigure(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2023, 10, 1, 10, 5, 0, 0, time.Local)
+	clock := WithClock(func() time.Time { return now })
+	h, err := NewHandler(LogDir(dir), DateTimeLayout("200601021504"), RotateEvery(15*time.Minute), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LateWriteGrace needs the record buffer, which
+	// Reconfigure cannot add: the option is ignored.
+	err = h.Reconfigure(LogDir(dir), DateTimeLayout("200601021504"), RotateEvery(15*time.Minute), LateWriteGrace(2*time.Minute), clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := func(msg string, t time.Time) error {
+		return h.Handle(context.Background(), slog.NewRecord(t, slog.LevelInfo, msg, 0))
+	}
+	handle("first", now)
+	now = now.Add(11 * time.Minute)
+	handle("second", now)
+	err = handle("late", now.Add(-2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"msg":"late"`) {
+		t.Fatalf("late record not written to the current file: %q", data)
+	}
+}
+
+func TestLateWriteGraceRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2023, 10, 1, 10, 5, 0, 0, time.Local)
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405"),
+		RotateEvery(15*time.Minute),
+		LateWriteGrace(2*time.Minute),
+		MaxFileSize(200),
+		MaxRotatedFiles(1),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := func(msg string, t time.Time) error {
+		return h.Handle(context.Background(), slog.NewRecord(t, slog.LevelInfo, msg, 0))
+	}
+	handle("first", now)
+	now = now.Add(11 * time.Minute)
+	handle("second", now)
+	// A size rotation within the grace window puts the
+	// rotated files over MaxRotatedFiles.
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		handle(strings.Repeat("x", 64), now)
+	}
+	err = handle("late", now.Add(-10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	data, err := os.ReadFile(filepath.Join(dir, "20231001100000.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"msg":"late"`) {
+		t.Fatalf("late record not written to the file of its bucket: %q", data)
+	}
+}
+
+func TestWithEncryption(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(256),
+		WithEncryption(func() ([]byte, error) { return key, nil }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 8; i++ {
+		logger.Info("secret msg", "i", i)
+	}
+	h.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, entry := range entries {
+		if entry.Name() == "current.log" {
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ENCRYPTED_FILE_EXTENSION) {
+			t.Fatalf("unencrypted rotated file %s", entry.Name())
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := DecryptFile(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(data, []byte(`"msg":"secret msg"`)) {
+			t.Fatalf("unexpected decrypted data: %q", data)
+		}
+		r, err := OpenRotated(path, WithEncryption(func() ([]byte, error) { return key, nil }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(read, data) {
+			t.Fatalf("unexpected data read from %s: %q, %v", path, read, err)
+		}
+		_, err = DecryptFile(path, bytes.Repeat([]byte{8}, 32))
+		if err == nil {
+			t.Fatal("file decrypted with the wrong key")
+		}
+		n++
+	}
+	if n == 0 {
+		t.Fatal("no encrypted rotated files")
+	}
+}
+
+func TestWithEncryptionFailure(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	var mu sync.Mutex
+	var calls int
+	var errs []error
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		WithEncryption(func() ([]byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if calls == 1 {
+				return nil, errors.New("kms down")
+			}
+			return key, nil
+		}),
+		OnError(func(err error) { errs = append(errs, err) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("secret msg", "i", i)
+		err = h.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger.Info("last msg")
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrEncrypt) {
+		t.Fatalf("got errors %v, expected %v", errs, ErrEncrypt)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain, encrypted int
+	for _, entry := range entries {
+		switch {
+		case entry.Name() == "current.log":
+		case strings.HasSuffix(entry.Name(), ENCRYPTED_FILE_EXTENSION):
+			encrypted++
+		default:
+			plain++
+		}
+	}
+	if plain != 1 || encrypted != 2 {
+		t.Fatalf("got %d plaintext and %d encrypted files, expected 1 and 2", plain, encrypted)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("last msg")) {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+}
+
+func TestOpenRotated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log.gz")
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("compressed msg\n"))
+	zw.Close()
+	err := os.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenRotated(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "compressed msg\n" {
+		t.Fatalf("unexpected data: %q", data)
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(256),
+		MaxRotatedFiles(16),
+		SequenceKey("seq"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rs []slog.Record
+	for i := 0; i < 16; i++ {
+		rs = append(rs, slog.NewRecord(time.Now(), slog.LevelInfo, "batched msg", 0))
+	}
+	rs = append(rs, slog.NewRecord(time.Now(), slog.LevelDebug, "disabled msg", 0))
+	err = h.HandleBatch(context.Background(), rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("wrong number of files: got %d, expected at least 2", len(entries))
+	}
+	if stats := h.Stats(); stats.Records != 16 {
+		t.Fatalf("wrong number of records: got %d, expected 16", stats.Records)
+	}
+}
+
+func TestRepairOnStart(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"current.log.idx",
+		"20230101000000.log",
+		"20230101000000.log.tmp.meta.json",
+		"20230102000000.log",
+		"20230102000000.log.enc",
+		"20230102000000.log.idx",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := NewHandler(LogDir(dir), RepairOnStart(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{"20230101000000.log", "20230102000000.log.enc", "20230102000000.log.enc.idx", "current.log"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("wrong files after repair: got %v, expected %v", names, expected)
+	}
+}
+
+func TestMinRotationInterval(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2023, 10, 1, 10, 0, 0, 0, time.Local)
+	h, err := NewHandler(
+		LogDir(dir),
+		MaxFileSize(64),
+		MaxRotatedFiles(16),
+		MinRotationInterval(time.Minute),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 8; i++ {
+		logger.Info("burst msg")
+		now = now.Add(time.Second)
+	}
+	now = now.Add(time.Minute)
+	logger.Info("late msg")
+	h.Close()
+
+	if stats := h.Stats(); stats.Rotations != 2 {
+		t.Fatalf("wrong number of rotations: got %d, expected 2", stats.Rotations)
+	}
+}
+
+func TestPerProcessCurrent(t *testing.T) {
+	dir := t.TempDir()
+	other := filepath.Join(dir, "current.1.log")
+	err := os.WriteFile(other, []byte("other process msg\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(64),
+		MaxRotatedFiles(1),
+		PerProcessCurrent(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 4; i++ {
+		logger.Info("worker msg")
+	}
+	current := filepath.Join(dir, fmt.Sprintf("current.%d.log", os.Getpid()))
+	_, err = os.Stat(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	_, err = os.Stat(current)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("current file not removed on Close: %v", err)
+	}
+	_, err = os.Stat(other)
+	if err != nil {
+		t.Fatalf("current file of other process removed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("wrong number of files: got %d, expected 2", len(entries))
+	}
+}
+
+func TestRingFiles(t *testing.T) {
+	dir := t.TempDir()
+	options := []optFun{LogDir(dir), MaxFileSize(64), MaxRotatedFiles(3), RingFiles(true)}
+	h, err := NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot0, err := os.Stat(filepath.Join(dir, "slot0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 10; i++ {
+		logger.Info("ring msg")
+	}
+	h.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{"slot.ring", "slot0.log", "slot1.log", "slot2.log"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("wrong files: got %v, expected %v", names, expected)
+	}
+	info, err := os.Stat(filepath.Join(dir, "slot0.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(slot0, info) {
+		t.Fatal("slot file replaced")
+	}
+	rotations := h.Stats().Rotations
+	if rotations < 3 {
+		t.Fatalf("wrong number of rotations: got %d, expected at least 3", rotations)
+	}
+	index, err := os.ReadFile(filepath.Join(dir, "slot.ring"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot := fmt.Sprint(rotations % 3); string(index) != slot {
+		t.Fatalf("wrong ring index: got %s, expected %s", index, slot)
+	}
+
+	h, err = NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if path := h.(handler).w.Path(); filepath.Base(path) != "slot"+string(index)+".log" {
+		t.Fatalf("wrong slot resumed: %s", path)
+	}
+}
+
+func TestNumberedRotation(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		FilePrefix("app."),
+		MaxRotatedFiles(3),
+		NumberedRotation(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 5; i++ {
+		logger.Info("numbered msg", "i", i)
+		err = h.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("wrong number of files: got %d, expected 4", len(entries))
+	}
+	for n := 1; n <= 3; n++ {
+		data, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("app.%d.log", n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf(`"i":%d}`, 5-n)
+		if !bytes.Contains(data, []byte(expected)) {
+			t.Fatalf("unexpected data in file %d: got %q, expected %q", n, data, expected)
+		}
+	}
+
+	err = h.Reconfigure(LogDir(dir), NumberedRotation(true), RingFiles(true))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("wrong error: got %v, expected %v", err, ErrInvalidConfig)
+	}
+
+	// Without a separator in the prefix the number follows it directly.
+	err = h.Reconfigure(LogDir(dir), FilePrefix("app"), MaxRotatedFiles(3), NumberedRotation(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("numbered msg", "i", 5)
+	err = h.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "app1.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishOnComplete(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		FilePrefix("app-"),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(64),
+		MaxRotatedFiles(16),
+		PublishOnComplete(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 4; i++ {
+		logger.Info("published msg")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var published int
+	for _, entry := range entries {
+		switch name := entry.Name(); {
+		case name == ".app-current.log.tmp":
+		case strings.HasPrefix(name, "app-") && strings.HasSuffix(name, ".log"):
+			published++
+		default:
+			t.Fatalf("unexpected file %s", name)
+		}
+	}
+	if published != int(h.Stats().Rotations) || published == 0 {
+		t.Fatalf("wrong number of published files: got %d, expected %d", published, h.Stats().Rotations)
+	}
+}
+
+func TestArchiveBundle(t *testing.T) {
+	dir := t.TempDir()
+	old := []string{"20230914120000.log", "20230930235959.log"}
+	for _, name := range old {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2023, 10, 1, 10, 0, 0, 0, time.Local)
+	h, err := NewHandler(
+		LogDir(dir),
+		MaxFileSize(64),
+		ArchiveBundle(BundleMonthly, nil),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("bundled msg")
+	logger.Info("bundled msg")
+	h.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{"2023-09.tar.gz", "20231001100000.log", "current.log"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("wrong files: got %v, expected %v", names, expected)
+	}
+	r, err := OpenRotated(filepath.Join(dir, "2023-09.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for _, name := range old {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != name || string(data) != name+"\n" {
+			t.Fatalf("unexpected bundle entry %s: %q", hdr.Name, data)
+		}
+	}
+
+	// Bundles are aged from the end of their period: the September
+	// bundle expires an hour after midnight of October 1st.
+	options := []optFun{
+		LogDir(dir),
+		MaxAge(time.Hour),
+		ArchiveBundle(BundleMonthly, nil),
+		WithClock(func() time.Time { return now }),
+	}
+	rotate := func() {
+		h, err := NewHandler(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+		now = now.Add(time.Second)
+		slog.New(h).Info("bundled msg")
+		err = h.Rotate()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = time.Date(2023, 10, 1, 0, 30, 0, 0, time.Local)
+	rotate()
+	if _, err := os.Stat(filepath.Join(dir, "2023-09.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	now = time.Date(2023, 10, 1, 1, 30, 0, 0, time.Local)
+	rotate()
+	if _, err := os.Stat(filepath.Join(dir, "2023-09.tar.gz")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired bundle not removed: %v", err)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(LogDir(dir), OnClosedWrite(ClosedDiscard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("healthy msg")
+	if err := h.Healthy(); err != nil {
+		t.Fatalf("unexpected health error: %v", err)
+	}
+	h.Close()
+	logger.Info("discarded msg")
+	if err := h.Healthy(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("wrong health error: got %v, expected %v", err, ErrClosed)
+	}
+
+	file := filepath.Join(dir, "file")
+	err = os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err = NewHandler(LogDir(filepath.Join(file, "logs")), FallbackToStderr(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Healthy(); !errors.Is(err, ErrDegraded) {
+		t.Fatalf("wrong health error: got %v, expected %v", err, ErrDegraded)
+	}
+}
+
+func TestCurrentFileAge(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		MaxFileSize(64),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	now = now.Add(time.Minute)
+	if age := h.CurrentFileAge(); age != time.Minute {
+		t.Fatalf("wrong file age: got %v, expected %v", age, time.Minute)
+	}
+	logger.Info("first msg")
+	logger.Info("second msg")
+	if age := h.CurrentFileAge(); age != 0 {
+		t.Fatalf("wrong file age after rotation: got %v, expected 0", age)
+	}
+}
+
+func TestRateLimitPerKey(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	h, err := NewHandler(
+		LogDir(dir),
+		RateLimitPerKey("", 1, 2),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	for i := 0; i < 5; i++ {
+		logger.Info("flood msg")
+	}
+	logger.Info("other msg")
+	now = now.Add(time.Second)
+	logger.Info("flood msg")
+	if stats := h.Stats(); stats.Suppressed != 3 {
+		t.Fatalf("wrong number of suppressed records: got %d, expected 3", stats.Suppressed)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("flood msg")); n != 3 {
+		t.Fatalf("wrong number of flood records: got %d, expected 3", n)
+	}
+	if !bytes.Contains(data, []byte("other msg")) {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+
+	err = h.Reconfigure(LogDir(dir), RateLimitPerKey("", 1, 0))
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("wrong error: got %v, expected %v", err, ErrInvalidConfig)
+	}
+	for _, option := range []optFun{RateLimitPerKey("", 1, 0), RateLimitPerKey("", -1, 1)} {
+		_, err = NewHandler(LogDir(t.TempDir()), option)
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("wrong error: got %v, expected %v", err, ErrInvalidConfig)
+		}
+	}
+}
+
+func TestSummaryInterval(t *testing.T) {
+	dir := t.TempDir()
+	ticks := make(chan time.Time)
+	h, err := NewHandler(
+		LogDir(dir),
+		RateLimitPerKey("", 1, 1),
+		SummaryInterval(50*time.Millisecond),
+		withTicks(ticks),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 4; i++ {
+		logger.Info("flood msg")
+	}
+	// The second tick, and the summary written by Close,
+	// find no drops and write nothing.
+	ticks <- time.Now()
+	ticks <- time.Now()
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("suppressed records")); n != 1 {
+		t.Fatalf("wrong number of summaries: got %d, expected 1", n)
+	}
+	if !bytes.Contains(data, []byte(`"event":"suppressed","count":3,"byReason":{"rateLimit":3}`)) {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+}
+
+func TestSummaryOnClose(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		RateLimitPerKey("", 1, 1),
+		SequenceKey("seq"),
+		SummaryInterval(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("a", 1)
+	for i := 0; i < 4; i++ {
+		logger.Info("flood msg")
+	}
+	err = h.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrong number of records: got %d, expected 2: %q", len(lines), data)
+	}
+	// The rate limiter, exhausted by the first record, does not apply to
+	// the summary, which takes neither a sequence number nor derived attrs.
+	if !strings.Contains(lines[1], `"msg":"suppressed records","event":"suppressed","count":3,"byReason":{"rateLimit":3}}`) {
+		t.Fatalf("unexpected summary: %q", lines[1])
+	}
+}
+
+func TestOptionsFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("APP_LOG_DIR", dir)
+	t.Setenv("APP_MAX_FILE_SIZE", "1K")
+	t.Setenv("APP_MAX_ROTATED_FILES", "3")
+	t.Setenv("APP_FORMAT", "text")
+	options, err := OptionsFromEnv("APP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	cnf := h.(handler).cnf
+	if cnf.logDir != dir || cnf.maxFileSize != 1024 || cnf.maxRotatedFiles != 3 {
+		t.Fatalf("wrong configuration: dir %q, size %d, files %d", cnf.logDir, cnf.maxFileSize, cnf.maxRotatedFiles)
+	}
+	slog.New(h).Info("env msg")
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("msg=\"env msg\"")) {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+
+	t.Setenv("APP_MAX_FILE_SIZE", "1X")
+	_, err = OptionsFromEnv("APP")
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("wrong error: got %v, expected %v", err, ErrInvalidConfig)
+	}
+}
+
+func TestProbeWrite(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(LogDir(dir), ProbeWrite(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "current.log" {
+		t.Fatalf("unexpected log directory entries: %v", entries)
+	}
+
+	if runtime.GOOS == "windows" || os.Getuid() == 0 {
+		t.Skip("read-only directories are writable")
+	}
+	readOnly := filepath.Join(t.TempDir(), "logs")
+	err = os.Mkdir(readOnly, 0555)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewHandler(LogDir(readOnly), ProbeWrite(true))
+	if !errors.Is(err, ErrNotWritable) {
+		t.Fatalf("wrong error: got %v, expected %v", err, ErrNotWritable)
+	}
+}
+
+func TestLazyFormatter(t *testing.T) {
+	dir := t.TempDir()
+	var built int
+	h, err := NewHandler(
+		LogDir(dir),
+		LazyFormatter(true),
+		LogHandlerBuilder(func(w io.Writer, opts *slog.HandlerOptions) *slog.TextHandler {
+			built++
+			return slog.NewTextHandler(w, opts)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if built != 0 {
+		t.Fatalf("formatter built at creation")
+	}
+	logger := slog.New(h)
+	logger.Info("lazy msg")
+	logger.Info("lazy msg")
+	if built != 1 {
+		t.Fatalf("wrong number of formatter builds: got %d, expected 1", built)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("msg=\"lazy msg\"")); n != 2 {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+}
+
+func TestCleanupSchedule(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(32),
+		MaxRotatedFiles(2),
+		CleanupSchedule(4, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	count := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries) - 1
+	}
+	for i := 0; i < 4; i++ {
+		logger.Info("scheduled msg")
+	}
+	if n := count(); n != 3 {
+		t.Fatalf("wrong number of rotated files before cleanup: got %d, expected 3", n)
+	}
+	logger.Info("scheduled msg")
+	if n := count(); n != 2 {
+		t.Fatalf("wrong number of rotated files after cleanup: got %d, expected 2", n)
+	}
+	logger.Info("scheduled msg")
+	h.Close()
+	if n := count(); n != 2 {
+		t.Fatalf("wrong number of rotated files after Close: got %d, expected 2", n)
+	}
+}
+
+func TestCleanupScheduleExcess(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(32),
+		MaxRotatedFiles(1),
+		CleanupSchedule(4, 0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	hh := h.(handler)
+	rotated := func() []string {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			if hh.cnf.isRotatedFileName(e.Name()) {
+				names = append(names, e.Name())
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	logger := slog.New(h)
+	for i := 0; i < 4; i++ {
+		logger.Info("scheduled msg")
+	}
+	before := rotated()
+	if len(before) != 3 {
+		t.Fatalf("wrong number of rotated files before cleanup: got %d, expected 3", len(before))
+	}
+	logger.Info("scheduled msg")
+	after := rotated()
+	if len(after) != 1 {
+		t.Fatalf("wrong number of rotated files after cleanup: got %d (%v), expected 1", len(after), after)
+	}
+	for _, name := range before {
+		if name == after[0] {
+			t.Fatalf("cleanup kept %s, one of the oldest rotated files %v", name, before)
+		}
+	}
+}
+
+type testCollector struct {
+	writes    int
+	bytes     int
+	rotations []RotationReason
+	drops     []string
+	errors    int
+}
+
+func (c *testCollector) RecordWrite(bytes int, d time.Duration) {
+	c.writes++
+	c.bytes += bytes
+}
+
+func (c *testCollector) RecordRotation(reason RotationReason, d time.Duration) {
+	c.rotations = append(c.rotations, reason)
+}
+
+func (c *testCollector) RecordDrop(reason string) {
+	c.drops = append(c.drops, reason)
+}
+
+func (c *testCollector) RecordError(err error) {
+	c.errors++
+}
+
+func TestWithMetrics(t *testing.T) {
+	dir := t.TempDir()
+	collector := &testCollector{}
+	h, err := NewHandler(
+		LogDir(dir),
+		MaxFileSize(128),
+		RateLimitPerKey("", 1, 2),
+		WithMetrics(collector),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 3; i++ {
+		logger.Info("measured msg")
+	}
+	stats := h.Stats()
+	h.Close()
+
+	if collector.writes != 2 || uint64(collector.bytes) != stats.Bytes {
+		t.Fatalf("wrong writes: got %d of %d bytes, expected 2 of %d bytes", collector.writes, collector.bytes, stats.Bytes)
+	}
+	if len(collector.rotations) != 1 || collector.rotations[0] != RotateSize {
+		t.Fatalf("wrong rotations: got %v, expected [%v]", collector.rotations, RotateSize)
+	}
+	if len(collector.drops) != 1 || collector.drops[0] != "rateLimit" {
+		t.Fatalf("wrong drops: got %v, expected [rateLimit]", collector.drops)
+	}
+	if collector.errors != 0 {
+		t.Fatalf("unexpected errors: %d", collector.errors)
+	}
+}
+
+func TestDerivedLoggerAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(LogDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h).With("k", "v").WithGroup("g")
+	check := func(dir, msg string) {
+		t.Helper()
+		logger.Info(msg, "i", 1)
+		data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf(`"msg":"%s","k":"v","g":{"i":1}}`, msg)
+		if !bytes.Contains(data, []byte(expected)) {
+			t.Fatalf("unexpected log data: got %q, expected %q", data, expected)
+		}
+	}
+	check(dir, "first msg")
+	err = h.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dir, "rotated msg")
+	err = h.Reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dir, "reopened msg")
+	newDir := t.TempDir()
+	err = h.Reconfigure(LogDir(newDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(newDir, "reconfigured msg")
+}
+
+func TestCloseDerived(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(LogDir(dir), OnClosedWrite(ClosedError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := h.WithAttrs([]slog.Attr{slog.String("k", "v")})
+	err = derived.(Handler).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = derived.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "derived msg", 0))
+	if err != nil {
+		t.Fatalf("derived handler stopped by its own Close: %v", err)
+	}
+	h.Close()
+	err = derived.Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "late msg", 0))
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("wrong error: got %v, expected %v", err, ErrClosed)
+	}
+}
+
+func TestIncludeGeneration(t *testing.T) {
+	dir := t.TempDir()
+	for gen := 1; gen <= 3; gen++ {
+		h, err := NewHandler(
+			LogDir(dir),
+			FilePrefix("app-"),
+			MaxRotatedFiles(2),
+			IncludeGeneration(true),
+			RetainAcrossGenerations(gen == 3),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := slog.New(h)
+		for i := 0; i < 2; i++ {
+			logger.Info("generation msg")
+			err = h.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.Close()
+		current := fmt.Sprintf("app-gen%d-current.log", gen)
+		if _, err := os.Stat(filepath.Join(dir, current)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rotated int
+	for _, e := range entries {
+		if e.Name() != GENERATION_FILE_NAME && !strings.HasSuffix(e.Name(), "-current.log") {
+			rotated++
+		}
+	}
+	if rotated != 2 {
+		t.Fatalf("wrong number of rotated files: got %d, expected 2", rotated)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, GENERATION_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "3\n" {
+		t.Fatalf("wrong generation file: got %q, expected %q", data, "3\n")
+	}
+}
+
+func TestLogDirRemoved(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	h, err := NewHandler(LogDir(dir), MaxFileSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.Info("first msg")
+	logger.Info("second msg")
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("recovered msg")
+	if err := h.Healthy(); err != nil {
+		t.Fatalf("unexpected health error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("recovered msg")) {
+		t.Fatalf("unexpected log data: %q", data)
+	}
+}
+
+func TestChainHeaders(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		DateTimeLayout("20060102150405.000000000"),
+		MaxFileSize(128),
+		MaxRotatedFiles(16),
+		ChainHeaders(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	for i := 0; i < 8; i++ {
+		logger.Info("chained msg")
+	}
+	h.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chain int
+	for name := "current.log"; name != ""; chain++ {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var header struct {
+			Msg    string `json:"msg"`
+			Prev   string `json:"prev"`
+			Reason string `json:"reason"`
+		}
+		err = json.NewDecoder(f).Decode(&header)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Msg != "rotoslog header" {
+			break
+		}
+		if header.Reason != "size" {
+			t.Fatalf("wrong rotation reason in %s: got %s, expected size", name, header.Reason)
+		}
+		name = header.Prev
+	}
+	// The first file has no header.
+	if chain+1 != len(entries) {
+		t.Fatalf("broken chain of files: got %d files, expected %d", chain+1, len(entries))
+	}
+}
+
+func TestCarryOverBytes(t *testing.T) {
+	dir := t.TempDir()
+	h, err := NewHandler(
+		LogDir(dir),
+		MaxFileSize(64),
+		CarryOverBytes(16),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h)
+	logger.Info("first msg", "state", "s1")
+	logger.Info("second msg")
+	h.Close()
+
+	f, err := os.Open(filepath.Join(dir, "current.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var carryOver struct {
+		Msg  string `json:"msg"`
+		Prev string `json:"prev"`
+		Data string `json:"data"`
+	}
+	err = json.NewDecoder(f).Decode(&carryOver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carryOver.Msg != "rotoslog carry-over" {
+		t.Fatalf("wrong first record message: got %q, expected %q", carryOver.Msg, "rotoslog carry-over")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, carryOver.Prev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(data, []byte(carryOver.Data)) || len(carryOver.Data) != 16 {
+		t.Fatalf("wrong carried over data: got %q, expected the end of %q", carryOver.Data, data)
+	}
+}
+
+func TestOversizedRecordPolicy(t *testing.T) {
+	big := strings.Repeat("x", 256)
+	for _, policy := range []OversizedPolicy{OversizedDivert, OversizedTruncate} {
+		dir := t.TempDir()
+		h, err := NewHandler(LogDir(dir), MaxFileSize(128), OversizedRecordPolicy(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := slog.New(h)
+		logger.Info(big)
+		logger.Info("small msg")
+		h.Close()
+
+		data, err := os.ReadFile(filepath.Join(dir, "current.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		switch policy {
+		case OversizedDivert:
+			oversized, err := os.ReadFile(filepath.Join(dir, "oversized.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(oversized), big) || len(lines) != 1 {
+				t.Fatalf("oversized record not diverted: %q", data)
+			}
+		case OversizedTruncate:
+			if len(lines) != 2 || len(lines[0]) != 127 {
+				t.Fatalf("oversized record not truncated: %q", data)
+			}
+		}
+	}
+}
+
+func TestOverflowHandler(t *testing.T) {
+	var overflow bytes.Buffer
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		OnClosedWrite(ClosedError),
+		OverflowHandler(slog.NewTextHandler(&overflow, nil)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(h).With("a", 1)
+	logger.Info("persisted msg")
+	h.Close()
+	logger.Info("diverted msg")
+
+	if s := overflow.String(); strings.Contains(s, "persisted msg") || !strings.Contains(s, `msg="diverted msg" a=1`) {
+		t.Fatalf("unexpected overflow data: %q", s)
+	}
+	if stats := h.Stats(); stats.Diverted != 1 {
+		t.Fatalf("wrong number of diverted records: got %d, expected 1", stats.Diverted)
+	}
+}
+
+func TestStreamEnabled(t *testing.T) {
+	type tenantKey struct{}
+	h, err := NewHandler(
+		LogDir(t.TempDir()),
+		StreamEnabled(func(ctx context.Context) bool {
+			return ctx.Value(tenantKey{}) != "muted"
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	logger := slog.New(h)
+	logger.InfoContext(context.WithValue(context.Background(), tenantKey{}, "muted"), "muted msg")
+	logger.InfoContext(context.WithValue(context.Background(), tenantKey{}, "loud"), "loud msg")
+
+	l, err := countLinesInFile(h.(handler).cnf.currentFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != 1 {
+		t.Fatalf("wrong number of lines: got %d, expected 1", l)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// SignalAction is the type of the constants selecting the
+// operation performed by a handler when a signal is received.
+type SignalAction int
+
+const (
+	// SignalRotate rotates the current log file, see Handler.Rotate.
+	SignalRotate SignalAction = iota
+	// SignalFlush flushes the buffered records, see Handler.Flush.
+	SignalFlush
+	// SignalReopen reopens the current log file, see Handler.Reopen.
+	SignalReopen
+)
+
+// InstallSignalHandlers makes h perform the action associated to every
+// signal in actions when the process receives it, e.g. rotating on SIGUSR1
+// and flushing on SIGUSR2. The handler lock is acquired as for any other
+// operation. Signals are never handled unless installed, and are released
+// by calling the returned function or by closing h. Errors are passed to
+// the OnError function and to the meta logger.
+// On Windows only os.Interrupt can be received, and the signals used to
+// control log files on Unix, such as SIGHUP, SIGUSR1 and SIGUSR2, are not
+// available.
+func InstallSignalHandlers(h Handler, actions map[os.Signal]SignalAction) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	for sig := range actions {
+		signal.Notify(signals, sig)
+	}
+	var closed <-chan struct{}
+	hh, ok := signalHandler(h)
+	if ok {
+		closed = hh.st.stop
+	}
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case sig := <-signals:
+				err := runSignalAction(h, actions[sig])
+				if ok && err != nil {
+					hh.mu.Lock()
+					hh.reportError(fmt.Errorf("signal %v: %w", sig, err))
+					hh.mu.Unlock()
+				}
+			case <-closed:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// signalHandler returns the handler implementing h, if h
+// is a value or a pointer returned by this package.
+func signalHandler(h Handler) (handler, bool) {
+	switch hh := h.(type) {
+	case handler:
+		return hh, true
+	case *handler:
+		if hh != nil {
+			return *hh, true
+		}
+	}
+	return handler{}, false
+}
+
+// runSignalAction performs action on h.
+func runSignalAction(h Handler, action SignalAction) error {
+	switch action {
+	case SignalRotate:
+		return h.Rotate()
+	case SignalFlush:
+		return h.Flush()
+	case SignalReopen:
+		return h.Reopen()
+	}
+	return fmt.Errorf("unknown signal action %d", action)
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || dragonfly
+
+package rotoslog
+
+import (
+	"log/slog"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInstallSignalHandlers(t *testing.T) {
+	h, err := NewHandler(LogDir(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	stop := InstallSignalHandlers(h, map[os.Signal]SignalAction{syscall.SIGUSR1: SignalRotate})
+	defer stop()
+	slog.New(h).Info("signaled msg")
+
+	err = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-h.Events():
+		if event.Reason != RotateManual {
+			t.Fatalf("wrong rotation reason: got %v, expected %v", event.Reason, RotateManual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no rotation on signal")
+	}
+
+	hh := h.(handler)
+	for _, sh := range []Handler{hh, &hh} {
+		got, ok := signalHandler(sh)
+		if !ok || got.st != hh.st {
+			t.Fatalf("handler %T not unwrapped", sh)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import "time"
+
+// Stats holds the counters of the activity of a handler.
+type Stats struct {
+	// Records is the number of records written to log files.
+	Records uint64
+	// Bytes is the number of bytes written to log files.
+	Bytes uint64
+	// Rotations is the number of rotations of the current log file.
+	Rotations uint64
+	// Errors is the number of errors reported to OnError.
+	Errors uint64
+	// Diverted is the number of records passed to the OverflowHandler.
+	Diverted uint64
+	// Suppressed is the number of records dropped by RateLimitPerKey.
+	Suppressed uint64
+	// PendingTasks is the number of background tasks pending when the
+	// counters are read. It is not reset by StatsAndReset.
+	PendingTasks uint64
+	// LastSync is the time, according to the WithClock clock, of the latest
+	// sync of the current log file made by SyncInterval or SyncAbove, or the
+	// zero time if none was made. It is not reset by StatsAndReset.
+	LastSync time.Time
+}
+
+// add adds the counters of o to s.
+func (s *Stats) add(o Stats) {
+	s.Records += o.Records
+	s.Bytes += o.Bytes
+	s.Rotations += o.Rotations
+	s.Errors += o.Errors
+	s.Diverted += o.Diverted
+	s.Suppressed += o.Suppressed
+}
+
+// Stats implements the method of the Handler interface.
+func (h handler) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := h.st.stats
+	stats.add(h.st.intervalStats)
+	stats.PendingTasks = uint64(len(h.st.deletions))
+	stats.LastSync = h.st.lastSync
+	return stats
+}
+
+// StatsAndReset implements the method of the Handler interface.
+func (h handler) StatsAndReset() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := h.st.intervalStats
+	h.st.stats.add(stats)
+	h.st.intervalStats = Stats{}
+	stats.PendingTasks = uint64(len(h.st.deletions))
+	stats.LastSync = h.st.lastSync
+	return stats
+}
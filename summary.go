@@ -0,0 +1,107 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Reasons of the records dropped, as reported by SummaryInterval.
+const (
+	dropRateLimit = "rateLimit"
+	dropFiltered  = "filtered"
+	dropError     = "error"
+	dropDeferred  = "deferred"
+)
+
+// SummaryInterval makes the handler write, every interval, a record
+// reporting the number of records dropped during the interval, so that
+// lossy configurations do not lose records silently. The record has the
+// message "suppressed records", a count attribute with the total and a
+// byReason group with the count of every reason: "rateLimit" for the
+// records dropped by RateLimitPerKey, "filtered" for the ones dropped by
+// the formatter, e.g. when sampling, "error" for the ones that could not
+// be written and were not passed to an OverflowHandler, and "deferred" for
+// the ones evicted from the DeferredPersist buffer. No record is written
+// for the intervals without drops. The summaries are written from
+// a background goroutine stopped by Close, like Heartbeat records, and a
+// last summary is written by Close. Like trailers, summaries are formatted
+// without the attributes and groups of derived handlers, and are neither
+// rate limited nor numbered by SequenceKey.
+// If interval is 0 no summary is written.
+func SummaryInterval(interval time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.summaryInterval = interval
+	}
+}
+
+// drop counts a record dropped for reason, if summaries are enabled,
+// and reports it to the MetricsCollector, if any.
+func (h handler) drop(reason string) {
+	if h.st.dropped != nil {
+		h.st.dropped[reason]++
+	}
+	if h.cnf.metrics != nil {
+		h.cnf.metrics.RecordDrop(reason)
+	}
+}
+
+// summarize writes a summary of the dropped records every interval until
+// the handler is closed. It must be called on the root handler.
+func (h handler) summarize(interval time.Duration) {
+	ticks, stop := h.cnf.newTicker(interval)
+	defer stop()
+	for {
+		select {
+		case <-h.st.stop:
+			return
+		case <-ticks:
+		}
+		h.mu.Lock()
+		if !h.st.closed {
+			err := h.writeSummary()
+			if err != nil {
+				h.reportError(err)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// writeSummary writes a record summarizing the records dropped since the
+// previous summary and resets their counters. While DeferredPersist holds
+// the records the counters are kept for the first summary after Persist.
+func (h handler) writeSummary() error {
+	if h.st.deferred != nil {
+		return nil
+	}
+	var count uint64
+	reasons := make([]string, 0, len(h.st.dropped))
+	for reason, n := range h.st.dropped {
+		count += n
+		reasons = append(reasons, reason)
+	}
+	if count == 0 {
+		return nil
+	}
+	sort.Strings(reasons)
+	byReason := make([]any, 0, len(reasons))
+	for _, reason := range reasons {
+		byReason = append(byReason, slog.Uint64(reason, h.st.dropped[reason]))
+	}
+	clear(h.st.dropped)
+	r := slog.NewRecord(time.Now(), h.cnf.level(), summaryMessage, 0)
+	r.AddAttrs(
+		slog.String("event", "suppressed"),
+		slog.Uint64("count", count),
+		slog.Group("byReason", byReason...),
+	)
+	root := h
+	root.formatter = h.st.formatter
+	return root.write(context.Background(), r)
+}
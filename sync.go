@@ -0,0 +1,56 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"fmt"
+	"time"
+)
+
+// SyncInterval makes the handler flush the buffered data and sync the current
+// log file to stable storage every interval, if records were written since
+// the previous sync, from a background goroutine stopped by Close. The file
+// is also synced before it is rotated and on Close. A crash of the system
+// can then lose at most the records written in the last interval, without
+// the cost of syncing every write. The time of the latest sync is reported
+// by Stats. If interval is 0 no periodic sync is made.
+func SyncInterval(interval time.Duration) optFun {
+	return func(cnf *config) {
+		cnf.syncInterval = interval
+	}
+}
+
+// syncPeriodically syncs the current log file every interval until the
+// handler is closed. It must be called on the root handler.
+func (h handler) syncPeriodically(interval time.Duration) {
+	ticks, stop := h.cnf.newTicker(interval)
+	defer stop()
+	for {
+		select {
+		case <-h.st.stop:
+			return
+		case <-ticks:
+		}
+		h.mu.Lock()
+		if !h.st.closed && !h.st.degraded && h.st.unsynced {
+			err := h.syncFile()
+			if err != nil {
+				h.reportError(err)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// syncFile flushes the buffered data and syncs the current log file.
+func (h handler) syncFile() error {
+	err := h.w.Sync()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWrite, err)
+	}
+	h.st.unsynced = false
+	h.st.lastSync = h.cnf.clock()
+	return nil
+}
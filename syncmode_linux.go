@@ -0,0 +1,22 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"os"
+	"syscall"
+)
+
+// openSyncFlag returns the open flag implementing mode and
+// whether Sync must be called after every write instead.
+func openSyncFlag(mode SyncMode) (int, bool) {
+	switch mode {
+	case SyncData:
+		return syscall.O_DSYNC, false
+	case SyncFull:
+		return os.O_SYNC, false
+	}
+	return 0, false
+}
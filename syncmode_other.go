@@ -0,0 +1,21 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package rotoslog
+
+import "os"
+
+// openSyncFlag returns the open flag implementing mode and
+// whether Sync must be called after every write instead.
+func openSyncFlag(mode SyncMode) (int, bool) {
+	switch mode {
+	case SyncData:
+		return 0, true
+	case SyncFull:
+		return os.O_SYNC, false
+	}
+	return 0, false
+}
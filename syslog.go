@@ -0,0 +1,23 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9 && !js && !wasip1
+
+package rotoslog
+
+import (
+	"io"
+	"log/slog"
+	"log/syslog"
+)
+
+// newSyslogLogger returns a logger writing to the system logger,
+// and the connection to close when the logger is no longer used.
+func newSyslogLogger() (*slog.Logger, io.Closer, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "rotoslog")
+	if err != nil {
+		return nil, nil, err
+	}
+	return slog.New(slog.NewTextHandler(w, nil)), w, nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9 || js || wasip1
+
+package rotoslog
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// newSyslogLogger fails, since log/syslog is not available on this platform.
+func newSyslogLogger() (*slog.Logger, io.Closer, error) {
+	return nil, nil, errors.New("rotoslog: syslog is not supported on this platform")
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Filippo Veneri. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package rotoslog
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+)
+
+// broadcaster fans out the written records to the live tail subscribers.
+// It has its own lock, since subscribers come and go outside of Handle.
+type broadcaster struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	closed  bool
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{clients: map[chan []byte]struct{}{}}
+}
+
+// subscribe returns a channel receiving the records written from now on,
+// or false if the broadcaster is closed.
+func (b *broadcaster) subscribe() (chan []byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, false
+	}
+	ch := make(chan []byte, DEFAULT_TAIL_BUFFER)
+	b.clients[ch] = struct{}{}
+	return ch, true
+}
+
+// unsubscribe removes the subscriber receiving from ch, if still present.
+func (b *broadcaster) unsubscribe(ch chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.clients[ch]; ok {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+// publish sends a copy of record to all the subscribers. Subscribers
+// whose channel is full are dropped, so that they never block logging.
+func (b *broadcaster) publish(record []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.clients) == 0 {
+		return
+	}
+	record = bytes.Clone(record)
+	for ch := range b.clients {
+		select {
+		case ch <- record:
+		default:
+			delete(b.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// close drops all the subscribers and rejects new ones.
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.clients {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+// ServeHTTP streams the records as Server-Sent Events, one event per record.
+func (b *broadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, ok := b.subscribe()
+	if !ok {
+		http.Error(w, "handler closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer b.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case record, ok := <-ch:
+			if !ok {
+				return
+			}
+			var event bytes.Buffer
+			for _, line := range bytes.Split(bytes.TrimSuffix(record, []byte{'\n'}), []byte{'\n'}) {
+				event.WriteString("data: ")
+				event.Write(line)
+				event.WriteByte('\n')
+			}
+			event.WriteByte('\n')
+			_, err := w.Write(event.Bytes())
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// TailHandler implements the method of the Handler interface.
+func (h handler) TailHandler() http.Handler {
+	if h.st.tail == nil {
+		return http.NotFoundHandler()
+	}
+	return h.st.tail
+}